@@ -0,0 +1,252 @@
+package supergood
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	domainutils "github.com/supergoodsystems/supergood-go/internal/domain-utils"
+	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
+)
+
+// ErrCircuitOpen is matched by the error returned for requests which are rejected
+// because the circuit breaker of their endpoint or domain is open
+var ErrCircuitOpen = errors.New("supergood: circuit breaker is open")
+
+// CircuitOpenError is returned for requests which are rejected without being sent
+// because the circuit breaker of their endpoint or domain is open.
+// It can be detected with errors.Is(err, ErrCircuitOpen).
+type CircuitOpenError struct {
+	// Key is the ID of the matched endpoint, or the domain if no endpoint matched
+	Key string
+	// RetryAfter is how long until the breaker lets a request through to probe the vendor
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("supergood: circuit breaker for %s is open, retry after %v", e.Key, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks the failures of requests to one endpoint or domain
+type circuitBreaker struct {
+	mutex       sync.Mutex
+	state       breakerState
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+	probeStart  time.Time
+}
+
+// allow reports whether a request can be sent, moving an open breaker to half-open
+// once the cooldown has passed so a single request can probe the vendor. Another
+// probe is allowed if the previous probe has not completed within the cooldown.
+func (b *circuitBreaker) allow(config *remoteconfig.CircuitBreaker, now time.Time) (bool, time.Duration, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	cooldown := breakerCooldown(config)
+	changed := false
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < cooldown {
+			return false, cooldown - now.Sub(b.openedAt), false
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		changed = true
+	}
+	if b.state == breakerHalfOpen {
+		if b.probing && now.Sub(b.probeStart) < cooldown {
+			return false, cooldown - now.Sub(b.probeStart), changed
+		}
+		b.probing = true
+		b.probeStart = now
+	}
+	return true, 0, changed
+}
+
+// release lets another request probe a half-open breaker, for a probe
+// whose outcome is unknown because the caller gave up on it
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// record counts the outcome of a request, returning the state of the breaker
+// and whether it changed
+func (b *circuitBreaker) record(config *remoteconfig.CircuitBreaker, failed bool, now time.Time) (breakerState, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else {
+			b.reset(now)
+		}
+		return b.state, true
+	}
+	if b.state == breakerOpen {
+		return b.state, false
+	}
+
+	window := time.Duration(config.WindowSeconds * float64(time.Second))
+	if window <= 0 {
+		window = time.Minute
+	}
+	if now.Sub(b.windowStart) >= window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return b.state, false
+	}
+	b.failures++
+	b.consecutive++
+
+	minRequests := config.MinRequests
+	if minRequests <= 0 {
+		minRequests = 10
+	}
+	if (config.ConsecutiveFailures > 0 && b.consecutive >= config.ConsecutiveFailures) ||
+		(config.ErrorRate > 0 && b.requests >= minRequests && float64(b.failures)/float64(b.requests) >= config.ErrorRate) {
+		b.open(now)
+		return b.state, true
+	}
+	return b.state, false
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.state = breakerClosed
+	b.consecutive = 0
+	b.requests = 0
+	b.failures = 0
+	b.windowStart = now
+}
+
+func breakerCooldown(config *remoteconfig.CircuitBreaker) time.Duration {
+	cooldown := time.Duration(config.CooldownSeconds * float64(time.Second))
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return cooldown
+}
+
+// circuitBreakers holds the breaker of each endpoint and domain
+type circuitBreakers struct {
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{breakers: map[string]*circuitBreaker{}}
+}
+
+func (c *circuitBreakers) get(key string) *circuitBreaker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	breaker, ok := c.breakers[key]
+	if !ok {
+		breaker = &circuitBreaker{windowStart: time.Now()}
+		c.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// breakerGuard is the circuit breaker applying to a single request
+type breakerGuard struct {
+	sg      *Service
+	key     string
+	config  *remoteconfig.CircuitBreaker
+	breaker *circuitBreaker
+}
+
+// circuitBreaker returns the breaker for a request, keyed by the matched endpoint or the
+// domain if no endpoint matched, or nil if no circuit breaker is configured for it
+func (sg *Service) circuitBreaker(req *http.Request, endpoint *remoteconfig.EndpointCacheVal) *breakerGuard {
+	domain := domainutils.GetDomainFromHost(req.URL.Host)
+	config := sg.RemoteConfig.GetCircuitBreaker(domain)
+	key := domain
+	if endpoint != nil {
+		key = endpoint.Id
+		if endpoint.CircuitBreaker != nil {
+			config = endpoint.CircuitBreaker
+		}
+	}
+	if config == nil || (config.ConsecutiveFailures <= 0 && config.ErrorRate <= 0) || key == "" {
+		return nil
+	}
+	return &breakerGuard{sg: sg, key: key, config: config, breaker: sg.breakers.get(key)}
+}
+
+// allow returns a CircuitOpenError if the request should not be sent
+func (g *breakerGuard) allow() error {
+	ok, retryAfter, changed := g.breaker.allow(g.config, time.Now())
+	if changed {
+		g.sg.breakerChanged(g.key, breakerHalfOpen)
+	}
+	if !ok {
+		return &CircuitOpenError{Key: g.key, RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// record counts a request as failed if it returned an error or a 5xx response.
+// Requests cancelled by the caller are not counted, while timeouts, including
+// the deadline of the caller's context, count as failures.
+func (g *breakerGuard) record(req *http.Request, resp *http.Response, err error) {
+	if errors.Is(err, context.Canceled) {
+		g.breaker.release()
+		return
+	}
+	failed := err != nil || (resp != nil && resp.StatusCode >= 500)
+	if state, changed := g.breaker.record(g.config, failed, time.Now()); changed {
+		g.sg.breakerChanged(g.key, state)
+	}
+}
+
+func (sg *Service) breakerChanged(key string, state breakerState) {
+	sg.metrics.recordBreakerState(key, state)
+	sg.options.Logger.Warn("supergood: circuit breaker state changed", "key", key, "state", state.String())
+	if sg.options.OnBreakerChange != nil {
+		sg.options.OnBreakerChange(key, state.String())
+	}
+}
@@ -0,0 +1,299 @@
+// Command supergood-replay uploads events from JSON Lines files to Supergood,
+// such as the files written in offline mode or the segments left in a spool
+// directory by a crashed process. It can be used to backfill events after an outage.
+//
+// Usage:
+//
+//	supergood-replay [flags] path...
+//
+// Each path is a .jsonl or .jsonl.gz file, or a directory containing them.
+// Events are deduplicated by request ID, keeping the latest snapshot of each,
+// redacted with the remote config, and uploaded in batches. Use -no-redact to skip
+// redaction for files written by the library, which are already redacted.
+// Use -progress to record the uploaded events, so a replay which failed part way
+// through can be resumed by running it again.
+// Credentials are read from SUPERGOOD_CLIENT_ID and SUPERGOOD_CLIENT_SECRET.
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/supergoodsystems/supergood-go"
+	"github.com/supergoodsystems/supergood-go/internal/spool"
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+	"github.com/supergoodsystems/supergood-go/pkg/redact"
+	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
+)
+
+// replayOptions are the flags controlling a replay
+type replayOptions struct {
+	configFile   string
+	dryRun       bool
+	redact       bool
+	batchEvents  int
+	batchBytes   int
+	progressFile string
+}
+
+func main() {
+	o := replayOptions{}
+	flag.StringVar(&o.configFile, "config", "", "read the remote config from a local file instead of fetching it from the Supergood API")
+	flag.BoolVar(&o.dryRun, "dry-run", false, "print the events as JSON Lines instead of uploading them")
+	noRedact := flag.Bool("no-redact", false, "upload events without redacting them, for files written by the library, which are already redacted")
+	flag.IntVar(&o.batchEvents, "batch-events", 1000, "maximum number of events per upload")
+	flag.IntVar(&o.batchBytes, "batch-bytes", 10000000, "maximum size in bytes of the events in an upload")
+	flag.StringVar(&o.progressFile, "progress", "", "record the IDs of uploaded events in this file, and skip them when run again")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	o.redact = !*noRedact
+
+	if flag.NArg() == 0 || o.batchEvents <= 0 || o.batchBytes <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var exporter supergood.Exporter
+	if !o.dryRun {
+		var err error
+		exporter, err = supergood.NewAPIExporter(nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := replay(flag.Args(), o, exporter, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// replay uploads the events in the files at paths with exporter,
+// or writes them to out for a dry run
+func replay(paths []string, o replayOptions, exporter supergood.Exporter, out io.Writer) error {
+	files, err := listFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	records := []*event.Event{}
+	for _, file := range files {
+		fileEvents, err := readFile(file)
+		if err != nil {
+			return err
+		}
+		records = append(records, fileEvents...)
+	}
+	events := spool.Merge(records)
+	fmt.Fprintf(os.Stderr, "read %d events from %d files\n", len(events), len(files))
+
+	if o.redact {
+		rc, err := loadConfig(o.configFile)
+		if err != nil {
+			return err
+		}
+		for _, err := range redact.Redact(events, rc) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	if o.dryRun {
+		encoder := json.NewEncoder(out)
+		for _, entry := range events {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var progress *os.File
+	if o.progressFile != "" {
+		done, err := readProgress(o.progressFile)
+		if err != nil {
+			return err
+		}
+		pending := []*event.Event{}
+		for _, entry := range events {
+			if !done[entry.Request.ID] {
+				pending = append(pending, entry)
+			}
+		}
+		if skipped := len(events) - len(pending); skipped > 0 {
+			fmt.Fprintf(os.Stderr, "skipping %d events uploaded by a previous run\n", skipped)
+		}
+		events = pending
+
+		progress, err = os.OpenFile(o.progressFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		defer progress.Close()
+	}
+
+	uploaded := 0
+	for _, batch := range splitBatches(events, o.batchEvents, o.batchBytes) {
+		if err := exporter.Export(context.Background(), batch); err != nil {
+			return fmt.Errorf("supergood: uploaded %d of %d events: %w", uploaded, len(events), err)
+		}
+		uploaded += len(batch)
+		if progress != nil {
+			if err := writeProgress(progress, batch); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "uploaded %d events\n", uploaded)
+	return nil
+}
+
+// readProgress reads the IDs of the events uploaded by previous runs, one per line.
+// A missing file means no events were uploaded.
+func readProgress(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			done[id] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// writeProgress records the IDs of an uploaded batch, syncing them to disk so
+// the batch is not uploaded again if the replay is interrupted
+func writeProgress(f *os.File, batch []*event.Event) error {
+	var b strings.Builder
+	for _, entry := range batch {
+		b.WriteString(entry.Request.ID)
+		b.WriteByte('\n')
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// listFiles expands directories to the event files in them, oldest first
+// for spool segments and files written by a file exporter
+func listFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() && (strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".jsonl.gz")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
+
+// readFile reads the events in a JSON Lines file, decompressing it if it ends in .gz.
+// Files cut short by a crash are read up to the last complete event.
+func readFile(path string) ([]*event.Event, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return spool.ReadSegment(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err == io.EOF {
+		return []*event.Event{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("supergood: invalid gzip file %s: %w", path, err)
+	}
+	return spool.Decode(gz, path)
+}
+
+// loadConfig reads the remote config from configFile, or fetches it from the Supergood API
+func loadConfig(configFile string) (*remoteconfig.RemoteConfig, error) {
+	baseURL := os.Getenv("SUPERGOOD_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.supergood.ai"
+	}
+
+	rc := remoteconfig.New(remoteconfig.RemoteConfigOpts{
+		BaseURL:      baseURL,
+		ClientID:     os.Getenv("SUPERGOOD_CLIENT_ID"),
+		ClientSecret: os.Getenv("SUPERGOOD_CLIENT_SECRET"),
+		Client:       http.DefaultClient,
+		HandleError:  func(err error) { fmt.Fprintln(os.Stderr, err) },
+		Offline:      configFile != "",
+		ConfigFile:   configFile,
+	})
+	if err := rc.Init(); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// splitBatches splits events into batches of at most maxEvents events and
+// maxBytes bytes. An event larger than maxBytes is sent on its own.
+func splitBatches(events []*event.Event, maxEvents int, maxBytes int) [][]*event.Event {
+	batches := [][]*event.Event{}
+	batch := []*event.Event{}
+	size := 0
+	for _, entry := range events {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		if len(batch) > 0 && (len(batch) >= maxEvents || size+len(b) > maxBytes) {
+			batches = append(batches, batch)
+			batch = []*event.Event{}
+			size = 0
+		}
+		batch = append(batch, entry)
+		size += len(b)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
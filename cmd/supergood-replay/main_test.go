@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supergoodsystems/supergood-go"
+	"github.com/supergoodsystems/supergood-go/internal/spool"
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// failingExporter succeeds for the given number of exports, then fails every export
+type failingExporter struct {
+	supergood.MemoryExporter
+	exports int
+}
+
+func (e *failingExporter) Export(ctx context.Context, events []*event.Event) error {
+	if e.exports == 0 {
+		return errors.New("upload failed")
+	}
+	e.exports--
+	return e.MemoryExporter.Export(ctx, events)
+}
+
+func writeEvents(t *testing.T, path string, lines ...string) {
+	var buf bytes.Buffer
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+	} else {
+		buf.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+}
+
+func ids(events []*event.Event) []string {
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.Request.ID)
+	}
+	return ids
+}
+
+func Test_Replay(t *testing.T) {
+	t.Run("split batches", func(t *testing.T) {
+		events := []*event.Event{}
+		for _, id := range []string{"1", "2", "3"} {
+			events = append(events, &event.Event{Request: &event.Request{ID: id}})
+		}
+		b, err := json.Marshal(events[0])
+		require.NoError(t, err)
+		size := len(b)
+		tests := []struct {
+			name      string
+			maxEvents int
+			maxBytes  int
+			batches   [][]string
+		}{
+			{"one batch", 10, 1000000, [][]string{{"1", "2", "3"}}},
+			{"by events", 2, 1000000, [][]string{{"1", "2"}, {"3"}}},
+			{"by bytes", 10, 2 * size, [][]string{{"1", "2"}, {"3"}}},
+			{"larger than max bytes", 10, 1, [][]string{{"1"}, {"2"}, {"3"}}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				batches := [][]string{}
+				for _, batch := range splitBatches(events, test.maxEvents, test.maxBytes) {
+					batches = append(batches, ids(batch))
+				}
+				require.Equal(t, test.batches, batches)
+			})
+		}
+		require.Empty(t, splitBatches(nil, 10, 10))
+	})
+
+	t.Run("list files", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"b.jsonl", "a.jsonl.gz", "notes.txt"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+		}
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "nested.jsonl"), 0o700))
+		single := filepath.Join(t.TempDir(), "single.json")
+		require.NoError(t, os.WriteFile(single, nil, 0o600))
+
+		files, err := listFiles([]string{single, dir})
+		require.NoError(t, err)
+		require.Equal(t, []string{single, filepath.Join(dir, "a.jsonl.gz"), filepath.Join(dir, "b.jsonl")}, files)
+
+		_, err = listFiles([]string{filepath.Join(dir, "missing")})
+		require.Error(t, err)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dir := t.TempDir()
+		writeEvents(t, filepath.Join(dir, "events-1.jsonl.gz"),
+			`{"request":{"id":"1"}}`,
+			`{"request":{"id":"2"}}`)
+		writeEvents(t, filepath.Join(dir, "events-2.jsonl"),
+			`{"request":{"id":"1"},"response":{"status":200}}`)
+
+		var out bytes.Buffer
+		require.NoError(t, replay([]string{dir}, replayOptions{dryRun: true}, nil, &out))
+		written, err := spool.Decode(&out, "stdout")
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2"}, ids(written))
+		require.Equal(t, 200, written[0].Response.Status)
+	})
+
+	t.Run("redact with a local config", func(t *testing.T) {
+		dir := t.TempDir()
+		writeEvents(t, filepath.Join(dir, "events.jsonl"),
+			`{"request":{"id":"1","url":"https://example.com/pay","body":{"card":"4242424242424242"}},"metadata":{"endpointId":"pay"}}`)
+		configFile := filepath.Join(t.TempDir(), "config.json")
+		config := `{"endpointConfig":[{"domain":"example.com","endpoints":[{"id":"pay","method":"POST",` +
+			`"matchingRegex":{"location":"path","regex":"/pay"},` +
+			`"endpointConfiguration":{"action":"Accept","sensitiveKeys":[{"keyPath":"requestBody.card","action":"REDACT"}]}}]}]}`
+		require.NoError(t, os.WriteFile(configFile, []byte(config), 0o600))
+
+		var out bytes.Buffer
+		require.NoError(t, replay([]string{dir}, replayOptions{dryRun: true, redact: true, configFile: configFile}, nil, &out))
+		require.NotContains(t, out.String(), "4242424242424242")
+		require.Contains(t, out.String(), "requestBody.card")
+	})
+
+	t.Run("resume after a failed upload", func(t *testing.T) {
+		dir := t.TempDir()
+		writeEvents(t, filepath.Join(dir, "events.jsonl"),
+			`{"request":{"id":"1"}}`,
+			`{"request":{"id":"2"}}`,
+			`{"request":{"id":"3"}}`)
+		o := replayOptions{batchEvents: 1, batchBytes: 1000000, progressFile: filepath.Join(t.TempDir(), "progress")}
+
+		exporter := &failingExporter{exports: 1}
+		require.ErrorContains(t, replay([]string{dir}, o, exporter, nil), "uploaded 1 of 3 events")
+		require.Equal(t, []string{"1"}, ids(exporter.Events()))
+
+		exporter = &failingExporter{exports: 10}
+		require.NoError(t, replay([]string{dir}, o, exporter, nil))
+		require.Equal(t, []string{"2", "3"}, ids(exporter.Events()))
+	})
+}
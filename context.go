@@ -0,0 +1,40 @@
+package supergood
+
+import "context"
+
+type contextKey int
+
+const (
+	tagsContextKey contextKey = iota
+	withoutCaptureContextKey
+)
+
+// WithTags returns a copy of ctx carrying tags, such as a tenant ID or feature name,
+// that are recorded in the metadata of requests made with it.
+// Tags are merged with, and override, any tags already carried by ctx.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := map[string]string{}
+	for k, v := range tagsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, tagsContextKey, merged)
+}
+
+// WithoutCapture returns a copy of ctx that prevents requests made with it
+// from being logged to supergood
+func WithoutCapture(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutCaptureContextKey, true)
+}
+
+func tagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsContextKey).(map[string]string)
+	return tags
+}
+
+func captureDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(withoutCaptureContextKey).(bool)
+	return disabled
+}
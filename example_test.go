@@ -61,3 +61,55 @@ func ExampleService_Wrap() {
 	}
 	defer resp.Body.Close()
 }
+
+func ExampleService_Middleware() {
+	sg, err := supergood.New(&supergood.Options{
+		ClientID:     os.Getenv("SUPERGOOD_CLIENT_ID"),
+		ClientSecret: os.Getenv("SUPERGOOD_CLIENT_SECRET"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sg.Close()
+
+	// log the requests your server receives, and the responses it writes
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+	http.ListenAndServe(":8080", sg.Middleware(mux))
+}
+
+func ExampleService_MetricsHandler() {
+	sg, err := supergood.New(&supergood.Options{
+		ClientID:     os.Getenv("SUPERGOOD_CLIENT_ID"),
+		ClientSecret: os.Getenv("SUPERGOOD_CLIENT_SECRET"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sg.Close()
+
+	// expose the client's metrics to be scraped by Prometheus
+	http.Handle("/metrics", sg.MetricsHandler())
+	http.ListenAndServe(":9090", nil)
+}
+
+func ExampleWithTags() {
+	sg, err := supergood.New(&supergood.Options{
+		ClientID:     os.Getenv("SUPERGOOD_CLIENT_ID"),
+		ClientSecret: os.Getenv("SUPERGOOD_CLIENT_SECRET"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sg.Close()
+
+	// record the tenant on the events of requests made with this context
+	ctx := supergood.WithTags(context.Background(), map[string]string{"tenant": "acme"})
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.example.com/", nil)
+	if err != nil {
+		panic(err)
+	}
+	sg.DefaultClient.Do(req)
+}
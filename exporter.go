@@ -0,0 +1,113 @@
+package supergood
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// Exporter receives batches of redacted events when the service flushes.
+// Export may be called again with the same batch if a retryable error
+// (a network error, a 5xx or 429 response from an HTTP API, or an error
+// marked with RetryableError) is returned.
+type Exporter interface {
+	Export(ctx context.Context, events []*event.Event) error
+}
+
+// RetryableError marks an error returned by an Exporter as temporary, so the batch
+// is retried with backoff rather than dropped. Errors in the chain with a
+// Retryable() bool method are also respected.
+type RetryableError struct {
+	Err error
+	// RetryAfter is the minimum delay before the batch is retried, if known
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetryableError) Retryable() bool {
+	return true
+}
+
+// NewAPIExporter creates an Exporter that uploads events to the Supergood API,
+// using the ClientID, ClientSecret, BaseURL, HTTPClient and Compression of o.
+// This is the default exporter when Options.Exporters is not set.
+func NewAPIExporter(o *Options) (Exporter, error) {
+	api := Options{}
+	if o != nil {
+		api = Options{
+			ClientID:            o.ClientID,
+			ClientSecret:        o.ClientSecret,
+			BaseURL:             o.BaseURL,
+			HTTPClient:          o.HTTPClient,
+			Compression:         o.Compression,
+			CompressionMinBytes: o.CompressionMinBytes,
+		}
+	}
+	if err := api.parseAPI(true); err != nil {
+		return nil, err
+	}
+	return &apiExporter{options: &api}, nil
+}
+
+type apiExporter struct {
+	options *Options
+}
+
+func (e *apiExporter) Export(ctx context.Context, events []*event.Event) error {
+	return e.options.post(ctx, e.options.BaseURL, "/events", events)
+}
+
+// NewWriterExporter creates an Exporter that writes events to w as JSON Lines,
+// one event per line. It can be used to write events to os.Stdout or a file.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
+
+type writerExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (e *writerExporter) Export(ctx context.Context, events []*event.Event) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	for _, entry := range events {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryExporter keeps exported events in memory, which is useful in tests
+type MemoryExporter struct {
+	mutex  sync.Mutex
+	events []*event.Event
+}
+
+func (e *MemoryExporter) Export(ctx context.Context, events []*event.Event) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.events = append(e.events, events...)
+	return nil
+}
+
+// Events returns the events exported so far
+func (e *MemoryExporter) Events() []*event.Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*event.Event{}, e.events...)
+}
@@ -0,0 +1,166 @@
+package supergood
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// FileExporterOptions configure a FileExporter
+type FileExporterOptions struct {
+	// Dir is the directory files are written to, created if needed
+	Dir string
+
+	// Prefix is the start of each file name, followed by the time the file was created
+	// (defaults to "events")
+	Prefix string
+
+	// MaxBytes is the number of uncompressed bytes after which a new file is started
+	// (defaults to 100000000, 100MB)
+	MaxBytes int
+
+	// MaxAge is how long events are written to a file before a new file is started
+	// (defaults to 1 * time.Hour)
+	MaxAge time.Duration
+
+	// Gzip compresses files, which are named .jsonl.gz instead of .jsonl
+	Gzip bool
+}
+
+// FileExporter writes events to JSON Lines files in a directory, one event per line,
+// starting a new file once the current file is too large or too old.
+// Files are only complete once rotated or closed, which matters when Gzip is set.
+type FileExporter struct {
+	options FileExporterOptions
+
+	mutex   sync.Mutex
+	file    *os.File
+	gzip    *gzip.Writer
+	w       io.Writer
+	written int
+	opened  time.Time
+	rotate  *time.Timer
+	closed  bool
+}
+
+// NewFileExporter creates a FileExporter. Files are not created until events are exported.
+func NewFileExporter(o FileExporterOptions) *FileExporter {
+	if o.Prefix == "" {
+		o.Prefix = "events"
+	}
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = 100000000 // 100MB
+	}
+	if o.MaxAge <= 0 {
+		o.MaxAge = time.Hour
+	}
+	return &FileExporter{options: o}
+}
+
+func (e *FileExporter) Export(ctx context.Context, events []*event.Event) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range events {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return fmt.Errorf("supergood: file exporter is closed")
+	}
+
+	if e.file != nil && (e.written >= e.options.MaxBytes || time.Since(e.opened) >= e.options.MaxAge) {
+		if err := e.closeFile(); err != nil {
+			return err
+		}
+	}
+	if e.file == nil {
+		if err := e.openFile(); err != nil {
+			return err
+		}
+	}
+
+	n, err := e.w.Write(buf.Bytes())
+	e.written += n
+	if err != nil {
+		return err
+	}
+	if e.gzip != nil {
+		// flush so events reach the disk before the file is rotated
+		return e.gzip.Flush()
+	}
+	return nil
+}
+
+// Close completes the current file. Events can not be exported once it is closed.
+func (e *FileExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.closed = true
+	return e.closeFile()
+}
+
+func (e *FileExporter) openFile() error {
+	if err := os.MkdirAll(e.options.Dir, 0o700); err != nil {
+		return fmt.Errorf("supergood: unable to create export directory: %w", err)
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.jsonl", e.options.Prefix, now.UTC().Format("20060102T150405.000000000"))
+	if e.options.Gzip {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(e.options.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("supergood: unable to create export file: %w", err)
+	}
+
+	e.file = f
+	e.w = f
+	if e.options.Gzip {
+		e.gzip = gzip.NewWriter(f)
+		e.w = e.gzip
+	}
+	e.written = 0
+	e.opened = now
+	// the file is completed once it is too old even if no more events are exported
+	e.rotate = time.AfterFunc(e.options.MaxAge, func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if e.file == f {
+			e.closeFile()
+		}
+	})
+	return nil
+}
+
+func (e *FileExporter) closeFile() error {
+	if e.file == nil {
+		return nil
+	}
+	e.rotate.Stop()
+
+	var err error
+	if e.gzip != nil {
+		err = e.gzip.Close()
+	}
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	e.file = nil
+	e.gzip = nil
+	e.w = nil
+	return err
+}
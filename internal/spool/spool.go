@@ -0,0 +1,240 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".jsonl"
+)
+
+// Spool persists events to append-only segment files in a directory so that
+// events which have not been uploaded survive a crash of the process.
+// Each line of a segment is a JSON encoded snapshot of an event. Later
+// snapshots of the same event (e.g. once the response has been logged)
+// replace earlier ones.
+type Spool struct {
+	dir       string
+	mutex     sync.Mutex
+	file      *os.File
+	written   int
+	seq       int
+	leftovers []string
+}
+
+// Open creates dir if needed and starts a new segment in it.
+// Segments left over from a previous process can be read with Recover.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("supergood: unable to create spool directory: %w", err)
+	}
+
+	leftovers, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, leftovers: leftovers}
+	if len(leftovers) > 0 {
+		s.seq = segmentSeq(leftovers[len(leftovers)-1])
+	}
+	if err := s.openSegment(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append writes a snapshot of e to the active segment
+func (s *Spool) Append(e *event.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("supergood: spool is closed")
+	}
+	n, err := s.file.Write(b)
+	s.written += n
+	return err
+}
+
+// Rotate seals the active segment, syncing it to disk, and starts a new one.
+// The path of the sealed segment is returned so it can be committed
+// once the events in it have been uploaded.
+func (s *Spool) Rotate() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return "", fmt.Errorf("supergood: spool is closed")
+	}
+
+	sealed := s.file.Name()
+	if err := s.file.Sync(); err != nil {
+		return "", err
+	}
+	if err := s.file.Close(); err != nil {
+		return "", err
+	}
+	s.file = nil
+	return sealed, s.openSegment()
+}
+
+// Commit removes segments whose events have been uploaded
+func (s *Spool) Commit(paths ...string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recover reads the segments left over from a previous process.
+// It returns the latest snapshot of each event in the order the events were
+// first written, along with the paths of the segments that were read.
+func (s *Spool) Recover() ([]*event.Event, []string, error) {
+	records := []*event.Event{}
+	for _, path := range s.leftovers {
+		segment, err := ReadSegment(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, segment...)
+	}
+	return Merge(records), s.leftovers, nil
+}
+
+// Merge returns the latest snapshot of each event, by request ID,
+// in the order the events were first written
+func Merge(records []*event.Event) []*event.Event {
+	events := []*event.Event{}
+	index := map[string]int{}
+	for _, e := range records {
+		if e.Request == nil {
+			continue
+		}
+		if i, ok := index[e.Request.ID]; ok {
+			events[i] = e
+			continue
+		}
+		index[e.Request.ID] = len(events)
+		events = append(events, e)
+	}
+	return events
+}
+
+// Close syncs and closes the active segment, removing it if nothing was written to it
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	if err == nil && s.written == 0 {
+		err = os.Remove(name)
+	}
+	return err
+}
+
+// ReadSegment reads every event snapshot in a segment file.
+// A partially written last line, as left by a crash, is ignored.
+func ReadSegment(path string) ([]*event.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Decode(f, path)
+}
+
+// Decode reads JSON Lines encoded events from r, such as a segment file or
+// the files written by a file exporter. A partially written last line is ignored.
+func Decode(r io.Reader, name string) ([]*event.Event, error) {
+	events := []*event.Event{}
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			e := &event.Event{}
+			if jsonErr := json.Unmarshal(line, e); jsonErr != nil {
+				return nil, fmt.Errorf("supergood: invalid event in %s: %w", name, jsonErr)
+			}
+			events = append(events, e)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (s *Spool) openSegment() error {
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, s.seq, segmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("supergood: unable to create spool segment: %w", err)
+	}
+	s.file = f
+	s.written = 0
+	return nil
+}
+
+// segments returns the paths of the segments in dir, oldest first
+func segments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || segmentSeq(entry.Name()) == 0 {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return segmentSeq(paths[i]) < segmentSeq(paths[j])
+	})
+	return paths, nil
+}
+
+// segmentSeq parses the sequence number out of a segment file name, returning 0 if it is not a segment
+func segmentSeq(path string) int {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return 0
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+	if err != nil {
+		return 0
+	}
+	return seq
+}
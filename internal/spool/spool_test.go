@@ -0,0 +1,149 @@
+package spool
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+func Test_Spool(t *testing.T) {
+	t.Run("recover merges snapshots of the same event", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := Open(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.Append(&event.Event{Request: &event.Request{ID: "1"}}))
+		require.NoError(t, s.Append(&event.Event{Request: &event.Request{ID: "2"}}))
+		require.NoError(t, s.Append(&event.Event{Request: &event.Request{ID: "1"}, Response: &event.Response{Status: 200}}))
+		require.NoError(t, s.Close())
+
+		s, err = Open(dir)
+		require.NoError(t, err)
+		events, leftovers, err := s.Recover()
+		require.NoError(t, err)
+		require.Len(t, leftovers, 1)
+		require.Len(t, events, 2)
+		require.Equal(t, "1", events[0].Request.ID)
+		require.Equal(t, 200, events[0].Response.Status)
+		require.Equal(t, "2", events[1].Request.ID)
+		require.Nil(t, events[1].Response)
+	})
+
+	t.Run("rotate and commit", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := Open(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.Append(&event.Event{Request: &event.Request{ID: "1"}}))
+		sealed, err := s.Rotate()
+		require.NoError(t, err)
+		require.NoError(t, s.Commit(sealed))
+		require.NoError(t, s.Close())
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 0)
+	})
+
+	t.Run("partially written lines are ignored", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := Open(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.Append(&event.Event{Request: &event.Request{ID: "1"}}))
+		name := s.file.Name()
+		_, err = s.file.Write([]byte(`{"request":{"id":"2"`))
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		events, err := ReadSegment(name)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		require.Equal(t, "1", events[0].Request.ID)
+	})
+
+	t.Run("writer transforms snapshots in the background", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := Open(dir)
+		require.NoError(t, err)
+		w := NewWriter(s, func(e *event.Event) { e.Request.Body = nil }, func(err error) { require.NoError(t, err) })
+		e := &event.Event{Request: &event.Request{ID: "1", Body: "secret"}}
+		require.NoError(t, w.Append(e))
+		e.Response = &event.Response{Status: 200}
+		require.NoError(t, w.Append(e))
+		require.Equal(t, "secret", e.Request.Body)
+		name := s.file.Name()
+		require.NoError(t, w.Close())
+
+		events, err := ReadSegment(name)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		require.Nil(t, events[0].Request.Body)
+		require.Nil(t, events[0].Response)
+		require.Equal(t, 200, events[1].Response.Status)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		request := func(id string) *event.Event { return &event.Event{Request: &event.Request{ID: id}} }
+		response := func(id string, status int) *event.Event {
+			return &event.Event{Request: &event.Request{ID: id}, Response: &event.Response{Status: status}}
+		}
+		tests := []struct {
+			name     string
+			records  []*event.Event
+			ids      []string
+			statuses []int
+		}{
+			{"empty", nil, []string{}, []int{}},
+			{"distinct events", []*event.Event{request("1"), request("2")}, []string{"1", "2"}, []int{0, 0}},
+			{"latest snapshot wins", []*event.Event{request("1"), response("1", 200), response("1", 500)}, []string{"1"}, []int{500}},
+			{"first written order", []*event.Event{request("1"), request("2"), response("1", 200)}, []string{"1", "2"}, []int{200, 0}},
+			{"without request", []*event.Event{{Response: &event.Response{Status: 200}}, request("1")}, []string{"1"}, []int{0}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				ids := []string{}
+				statuses := []int{}
+				for _, e := range Merge(test.records) {
+					ids = append(ids, e.Request.ID)
+					status := 0
+					if e.Response != nil {
+						status = e.Response.Status
+					}
+					statuses = append(statuses, status)
+				}
+				require.Equal(t, test.ids, ids)
+				require.Equal(t, test.statuses, statuses)
+			})
+		}
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			input string
+			ids   []string
+			err   bool
+		}{
+			{"empty", "", []string{}, false},
+			{"complete lines", "{\"request\":{\"id\":\"1\"}}\n{\"request\":{\"id\":\"2\"}}\n", []string{"1", "2"}, false},
+			{"partial last line", "{\"request\":{\"id\":\"1\"}}\n{\"request\":", []string{"1"}, false},
+			{"invalid line", "{\"request\":{\"id\":\"1\"}}\nnot json\n", nil, true},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				events, err := Decode(strings.NewReader(test.input), "test.jsonl")
+				if test.err {
+					require.ErrorContains(t, err, "test.jsonl")
+					return
+				}
+				require.NoError(t, err)
+				ids := []string{}
+				for _, e := range events {
+					ids = append(ids, e.Request.ID)
+				}
+				require.Equal(t, test.ids, ids)
+			})
+		}
+	})
+}
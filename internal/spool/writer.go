@@ -0,0 +1,132 @@
+package spool
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// Writer appends event snapshots to a Spool from a background goroutine, so that
+// capturing an event does not wait on the disk. Each snapshot is passed to
+// transform, e.g. to redact it, before it is written.
+type Writer struct {
+	*Spool
+	transform func(*event.Event)
+	onError   func(error)
+
+	mutex   sync.Mutex
+	pending [][]byte
+	// writing is held while snapshots are written, so Rotate and Close can
+	// wait for snapshots queued before them
+	writing sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewWriter starts writing snapshots to s in the background.
+// Errors writing snapshots in the background are passed to onError.
+func NewWriter(s *Spool, transform func(*event.Event), onError func(error)) *Writer {
+	w := &Writer{
+		Spool:     s,
+		transform: transform,
+		onError:   onError,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Append queues a snapshot of the current state of e to be written.
+// The snapshot is encoded immediately so e can be modified once Append returns.
+func (w *Writer) Append(e *event.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	w.pending = append(w.pending, b)
+	w.mutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Sync writes every queued snapshot to the active segment
+func (w *Writer) Sync() error {
+	w.writing.Lock()
+	defer w.writing.Unlock()
+	return w.write()
+}
+
+// Rotate writes the queued snapshots then seals the active segment, see [Spool.Rotate]
+func (w *Writer) Rotate() (string, error) {
+	w.writing.Lock()
+	defer w.writing.Unlock()
+	if err := w.write(); err != nil {
+		w.onError(err)
+	}
+	return w.Spool.Rotate()
+}
+
+// Close stops the background goroutine, writes the queued snapshots and closes the spool
+func (w *Writer) Close() error {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+
+	err := w.Sync()
+	if closeErr := w.Spool.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.wake:
+			if err := w.Sync(); err != nil {
+				w.onError(err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// write decodes, transforms and writes the queued snapshots. w.writing must be held.
+func (w *Writer) write() error {
+	w.mutex.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+
+	var err error
+	for _, b := range pending {
+		e := &event.Event{}
+		if decodeErr := json.Unmarshal(b, e); decodeErr != nil {
+			if err == nil {
+				err = decodeErr
+			}
+			continue
+		}
+		if w.transform != nil {
+			w.transform(e)
+		}
+		if appendErr := w.Spool.Append(e); appendErr != nil && err == nil {
+			err = appendErr
+		}
+	}
+	return err
+}
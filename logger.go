@@ -0,0 +1,88 @@
+package supergood
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Logger receives structured diagnostic records from the service. Args are
+// alternating keys and values, so a *slog.Logger can be used as a Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+// levelLogger drops records below the LogLevel before passing them on
+type levelLogger struct {
+	level int
+	next  Logger
+}
+
+func (l *levelLogger) Debug(msg string, args ...any) {
+	if l.level <= logLevels["debug"] {
+		l.next.Debug(msg, args...)
+	}
+}
+
+func (l *levelLogger) Info(msg string, args ...any) {
+	if l.level <= logLevels["info"] {
+		l.next.Info(msg, args...)
+	}
+}
+
+func (l *levelLogger) Warn(msg string, args ...any) {
+	if l.level <= logLevels["warn"] {
+		l.next.Warn(msg, args...)
+	}
+}
+
+func (l *levelLogger) Error(msg string, args ...any) {
+	if l.level <= logLevels["error"] {
+		l.next.Error(msg, args...)
+	}
+}
+
+// stderrLogger writes records to os.Stderr as key=value pairs.
+// It is used when a LogLevel is set without a Logger.
+type stderrLogger struct {
+	logger *log.Logger
+}
+
+func newStderrLogger() *stderrLogger {
+	return &stderrLogger{logger: log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (l *stderrLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *stderrLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *stderrLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *stderrLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func (l *stderrLogger) log(level string, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	l.logger.Println(b.String())
+}
+
+// discardLogger is used when neither a Logger nor a LogLevel is set
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, args ...any) {}
+func (discardLogger) Info(msg string, args ...any)  {}
+func (discardLogger) Warn(msg string, args ...any)  {}
+func (discardLogger) Error(msg string, args ...any) {}
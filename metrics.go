@@ -0,0 +1,187 @@
+package supergood
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drop reasons recorded by the supergood_events_dropped_total metric
+const (
+	dropCacheFull    = "cache_full"
+	dropExportFailed = "export_failed"
+	dropSampled      = "sampled"
+)
+
+// metrics counts what happens to events as they pass through the service
+type metrics struct {
+	mutex             sync.Mutex
+	captured          int
+	dropped           map[string]int
+	flushes           int
+	flushFailures     int
+	flushSeconds      float64
+	lastFlush         time.Time
+	lastFlushErr      error
+	configRefreshed   time.Time
+	configFailures    int
+	redactionFailures int
+	actions           map[endpointAction]int
+	breakerStates     map[string]breakerState
+	breakerChanges    map[breakerChange]int
+}
+
+type endpointAction struct {
+	endpointId string
+	action     string
+}
+
+type breakerChange struct {
+	key   string
+	state breakerState
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		dropped:        map[string]int{},
+		actions:        map[endpointAction]int{},
+		breakerStates:  map[string]breakerState{},
+		breakerChanges: map[breakerChange]int{},
+	}
+}
+
+func (m *metrics) recordCaptured() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.captured++
+}
+
+func (m *metrics) recordDropped(reason string, events int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dropped[reason] += events
+}
+
+func (m *metrics) recordFlush(duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.flushes++
+	if err != nil {
+		m.flushFailures++
+	}
+	m.flushSeconds += duration.Seconds()
+	m.lastFlush = time.Now()
+	m.lastFlushErr = err
+}
+
+func (m *metrics) recordConfigRefresh() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.configRefreshed = time.Now()
+}
+
+func (m *metrics) recordConfigFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.configFailures++
+}
+
+func (m *metrics) recordRedactionFailures(n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.redactionFailures += n
+}
+
+func (m *metrics) recordAction(endpointId string, action string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.actions[endpointAction{endpointId: endpointId, action: action}]++
+}
+
+func (m *metrics) recordBreakerState(key string, state breakerState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.breakerStates[key] = state
+	m.breakerChanges[breakerChange{key: key, state: state}]++
+}
+
+// MetricsHandler returns an http.Handler which serves metrics about the events
+// captured by the service in the Prometheus text exposition format.
+func (sg *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		sg.writeMetrics(rw)
+	})
+}
+
+func (sg *Service) writeMetrics(w io.Writer) {
+	t := sg.telemetry()
+	m := sg.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeMetric(w, "supergood_events_captured_total", "counter", "Requests captured as events.", nil, float64(m.captured))
+	writeMetric(w, "supergood_events_dropped_total", "counter", "Events dropped before being exported, by reason.", labelled("reason", m.dropped), 0)
+	writeMetric(w, "supergood_queue_bytes", "gauge", "Size of the events waiting to be flushed.", nil, float64(t.CacheSize))
+	writeMetric(w, "supergood_queue_keys", "gauge", "Number of events waiting to be flushed.", nil, float64(t.CacheKeyCount))
+	writeMetric(w, "supergood_flushes_total", "counter", "Flushes of queued events.", nil, float64(m.flushes))
+	writeMetric(w, "supergood_flush_failures_total", "counter", "Flushes in which an export failed.", nil, float64(m.flushFailures))
+	writeMetric(w, "supergood_flush_duration_seconds_total", "counter", "Time spent flushing events.", nil, m.flushSeconds)
+	age := -1.0
+	if !m.configRefreshed.IsZero() {
+		age = time.Since(m.configRefreshed).Seconds()
+	}
+	writeMetric(w, "supergood_remote_config_age_seconds", "gauge", "Time since the remote config was last refreshed, or -1 if it never was.", nil, age)
+	writeMetric(w, "supergood_remote_config_failures_total", "counter", "Failed remote config refreshes.", nil, float64(m.configFailures))
+	writeMetric(w, "supergood_redaction_failures_total", "counter", "Sensitive keys which could not be redacted.", nil, float64(m.redactionFailures))
+
+	actions := map[string]int{}
+	for key, count := range m.actions {
+		actions[fmt.Sprintf(`endpoint_id="%s",action="%s"`, labelEscaper.Replace(key.endpointId), labelEscaper.Replace(key.action))] = count
+	}
+	writeMetric(w, "supergood_endpoint_actions_total", "counter", "Requests matched against the remote config, by endpoint and action.", actions, 0)
+
+	states := map[string]int{}
+	for key, state := range m.breakerStates {
+		states[fmt.Sprintf(`key="%s"`, labelEscaper.Replace(key))] = int(state)
+	}
+	writeMetric(w, "supergood_circuit_breaker_state", "gauge", "State of the circuit breaker of each endpoint or domain: 0 closed, 1 open, 2 half-open.", states, 0)
+	changes := map[string]int{}
+	for change, count := range m.breakerChanges {
+		changes[fmt.Sprintf(`key="%s",state="%s"`, labelEscaper.Replace(change.key), change.state)] = count
+	}
+	writeMetric(w, "supergood_circuit_breaker_changes_total", "counter", "Circuit breaker state changes, by endpoint or domain and new state.", changes, 0)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelled converts counts keyed by a single label value into label sets
+func labelled(label string, counts map[string]int) map[string]int {
+	sets := map[string]int{}
+	for value, count := range counts {
+		sets[fmt.Sprintf(`%s="%s"`, label, labelEscaper.Replace(value))] = count
+	}
+	return sets
+}
+
+// writeMetric writes a metric family. If labels is not nil a sample is written
+// for each label set, otherwise a single sample with the given value.
+func writeMetric(w io.Writer, name string, kind string, help string, labels map[string]int, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if labels == nil {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+		return
+	}
+	sets := make([]string, 0, len(labels))
+	for set := range labels {
+		sets = append(sets, set)
+	}
+	sort.Strings(sets)
+	for _, set := range sets {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, set, labels[set])
+	}
+}
@@ -0,0 +1,203 @@
+package supergood
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// Middleware returns an http.Handler that logs the requests received by next,
+// and the responses it writes, to supergood. Requests are filtered using the
+// same remote config, AllowedDomains and SelectRequests rules as outbound requests.
+// Response bodies are held in memory until the handler returns, so set
+// MaxResponseBodyBytes when serving long-lived streams such as server-sent events.
+func (sg *Service) Middleware(next http.Handler) http.Handler {
+	return &middleware{sg: sg, next: next}
+}
+
+type middleware struct {
+	sg   *Service
+	next http.Handler
+}
+
+func (m *middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	req := absoluteRequest(r)
+	endpoint := m.sg.matchEndpoint(req)
+
+	endpointId := ""
+	endpointAction := "Accept"
+	if endpoint != nil {
+		endpointId = endpoint.Id
+		endpointAction = endpoint.Action
+	}
+
+	// Block and Mock only apply to outbound requests, inbound requests are
+	// always passed on to the handler
+	if !m.sg.shouldLogRequest(req, endpointAction) {
+		r.Body = req.Body
+		m.next.ServeHTTP(rw, r)
+		return
+	}
+
+	sampleRate, sampled := m.sg.sampleRequest(req, endpoint)
+	if !sampled && !m.sg.options.KeepErrors {
+		m.sg.metrics.recordDropped(dropSampled, 1)
+		r.Body = req.Body
+		m.next.ServeHTTP(rw, r)
+		return
+	}
+
+	maxRequestBodyBytes, maxResponseBodyBytes := m.sg.bodyLimits(endpoint)
+	id := uuid.New().String()
+	meta := event.MetaData{
+		EndpointId: endpointId,
+		SampleRate: sampleRate,
+		Tags:       tagsFromContext(req.Context()),
+	}
+	meta.TraceId, meta.SpanId = traceIDs(req)
+	logged := m.sg.logRequest(id, event.NewLimitedRequest(id, req, maxRequestBodyBytes), meta, sampled)
+	r.Body = req.Body
+	if !logged {
+		m.next.ServeHTTP(rw, r)
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: rw, limit: maxResponseBodyBytes, unsampled: !sampled}
+	defer func() {
+		if p := recover(); p != nil {
+			// the handler aborted the response, which is logged as a server error
+			// before the panic is passed on to the server
+			if rec.status == 0 {
+				rec.status = http.StatusInternalServerError
+				rec.header = rec.ResponseWriter.Header().Clone()
+			}
+			resp := event.NewResponse(rec.response(), nil)
+			resp.Error = &event.ResponseError{Kind: event.ErrorOther, Message: fmt.Sprintf("handler panicked: %v", p)}
+			m.sg.LogResponse(id, resp)
+			panic(p)
+		}
+	}()
+	m.next.ServeHTTP(rec, r)
+	if rec.hijacked {
+		// the handler took over the connection, e.g. for a websocket,
+		// so there is no response to capture
+		m.sg.discardRequest(id)
+		return
+	}
+	resp := event.NewResponse(rec.response(), nil)
+	if rec.size > rec.body.Len() {
+		resp.Truncated = true
+		resp.OriginalSize = rec.size
+	}
+	m.sg.LogResponse(id, resp)
+}
+
+// absoluteRequest returns a shallow copy of a server request with the scheme and host
+// populated on the URL, as server requests only carry the path and query.
+// Endpoint matching and event creation may replace the body of the returned request.
+func absoluteRequest(r *http.Request) *http.Request {
+	req := r.WithContext(r.Context())
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	req.URL = &u
+	return req
+}
+
+// responseRecorder passes writes through to the underlying http.ResponseWriter
+// while keeping a copy of the status, headers and up to limit bytes of the body
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	size     int
+	limit    int
+	hijacked bool
+	// the body of a successful response to a request which was not sampled
+	// is not recorded, as the event is dropped
+	unsampled bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	if rec.unsampled && isSuccess(rec.status) {
+		return n, err
+	}
+	recorded := b[:n]
+	if rec.limit > 0 && rec.body.Len()+n > rec.limit {
+		recorded = recorded[:rec.limit-rec.body.Len()]
+	}
+	rec.body.Write(recorded)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes through to the underlying http.ResponseWriter, so handlers can
+// take over the connection. Hijacked connections are not captured.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		rec.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (rec *responseRecorder) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := rec.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) response() *http.Response {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", rec.status, http.StatusText(rec.status)),
+		StatusCode: rec.status,
+		Header:     rec.header,
+		Body:       io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Options configure the Supergood service
@@ -52,6 +55,20 @@ type Options struct {
 	// (by default all requests are logged)
 	SelectRequests func(r *http.Request) bool
 
+	// SampleRate is the fraction of requests, between 0 and 1, that are logged to supergood.
+	// A rate of 0 logs no requests, other than errors if KeepErrors is set.
+	// The sample rate is recorded on each event so counts can be extrapolated.
+	// (defaults to 1, every request is logged)
+	SampleRate *float64
+
+	// DomainSampleRates overrides SampleRate for requests to the given domains.
+	// Sample rates set for an endpoint in the remote config take precedence.
+	// map[string]float64{"plaid.com": 0.1}
+	DomainSampleRates map[string]float64
+
+	// KeepErrors logs requests with a non 2xx response even when they are not sampled
+	KeepErrors bool
+
 	// FlushInterval configures how frequently supergood sends batches of
 	// logs to the API. (defaults to 1 * time.Second)
 	FlushInterval time.Duration
@@ -64,9 +81,19 @@ type Options struct {
 	// (defaults to http.DefaultClient)
 	HTTPClient *http.Client
 
-	// Log Level to use for logging, debug will print flushes
+	// LogLevel is the minimum level of the records sent to Logger: "debug", "info", "warn" or "error".
+	// Debug records include flushes, remote config refreshes and endpoint matches, while
+	// redaction failures, failed uploads and dropped events are logged as warnings.
+	// Unsupported levels are logged as a warning and replaced by "info".
+	// (defaults to "info", or no logging if neither LogLevel nor Logger is set.
+	// A Logger is passed every record if LogLevel is not set)
 	LogLevel string
 
+	// Logger receives structured diagnostic records, for example a *slog.Logger.
+	// Errors are still reported through OnError.
+	// (defaults to logging to os.Stderr if LogLevel is set)
+	Logger Logger
+
 	// RemoteConfigFetchInterval configures how frequently supergood retrieves
 	// the remote config which is used to ignore / accept traffic from client endpoints
 	// as well as mask sensitive keys
@@ -89,6 +116,111 @@ type Options struct {
 	// MaxCacheSizeBytes is the maximum size the cache can grow before we stop appending to the cache
 	MaxCacheSizeBytes int
 
+	// MaxRequestBodyBytes is the maximum number of bytes of a request body that is captured.
+	// Larger bodies are truncated and flagged in the event metadata. Truncated form, multipart,
+	// XML and JSON bodies which no longer parse are omitted, as their fields could not be redacted.
+	// Can be overridden per endpoint by the remote config.
+	// (by default request bodies are captured in full)
+	MaxRequestBodyBytes int
+
+	// MaxResponseBodyBytes is the maximum number of bytes of a response body that is captured.
+	// Larger bodies are truncated and flagged in the event metadata, and omitted if they can not
+	// be parsed, as for MaxRequestBodyBytes. Can be overridden per endpoint by the remote config.
+	// Responses written through Middleware are buffered up to this limit until the handler returns.
+	// (by default response bodies are captured in full)
+	MaxResponseBodyBytes int
+
+	// MaxBatchEvents is the maximum number of events sent to supergood in a single upload.
+	// Larger flushes are split into multiple uploads, each retried independently.
+	// (defaults to 1000)
+	MaxBatchEvents int
+
+	// MaxBatchBytes is the maximum size of the events sent to supergood in a single upload.
+	// An event larger than MaxBatchBytes is uploaded on its own.
+	// (defaults to 10000000, 10MB)
+	MaxBatchBytes int
+
+	// MaxRetries is the number of times a failed upload of events is retried before the events
+	// are dropped. Network errors, 5xx and 429 responses are retried.
+	// (defaults to 3, set to -1 to disable retries)
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry of a failed upload. The delay doubles
+	// with each attempt and is randomized with jitter. A Retry-After header sent by the API
+	// is honored if it is longer. (defaults to 1 * time.Second)
+	RetryBackoff time.Duration
+
+	// MaxRetryBackoff caps the delay between retries of a failed upload.
+	// (defaults to 30 * time.Second)
+	MaxRetryBackoff time.Duration
+
+	// OnDrop is called with events that are abandoned, either because their upload
+	// could not be retried or because they no longer fit within MaxCacheSizeBytes
+	// (by default dropped events are only reported through OnError)
+	OnDrop func(events []*event.Event, err error)
+
+	// OnBreakerChange is called when the circuit breaker of an endpoint or domain changes
+	// state, with the endpoint ID or domain and the new state: "open", "half-open" or "closed"
+	// (by default state changes are only logged and counted in the metrics)
+	OnBreakerChange func(key string, state string)
+
+	// Compression is the encoding used to compress events and telemetry sent to supergood.
+	// Supported values are "gzip" and "none". (defaults to "none")
+	Compression string
+
+	// CompressionMinBytes is the payload size below which payloads are sent uncompressed.
+	// (defaults to 1024)
+	CompressionMinBytes int
+
+	// TracerProvider is used to start an OpenTelemetry client span for each captured request,
+	// with the supergood endpoint ID and action as attributes. The trace and span IDs of
+	// the request context are recorded on events whether or not a TracerProvider is set.
+	// (by default no spans are started)
+	TracerProvider trace.TracerProvider
+
+	// Exporters receive the batches of redacted events sent on each flush, such as
+	// NewAPIExporter, NewWriterExporter or your own implementation. Use NewAPIExporter
+	// alongside your own exporters to keep sending events to supergood.
+	// Exporters implementing io.Closer, such as FileExporter, are closed when the service is closed.
+	// (defaults to uploading events to the Supergood API, or writing them to OfflineDir in offline mode)
+	Exporters []Exporter
+
+	// Offline disables every call to the Supergood API, for air-gapped and CI environments.
+	// The remote config is read from RemoteConfigFile instead of being fetched, telemetry and
+	// errors are not sent, and ClientID and ClientSecret are not required.
+	Offline bool
+
+	// OfflineDir is the directory events are written to in offline mode when Exporters is not set,
+	// as JSON Lines files rotated every hour or 100MB. Use NewFileExporter to configure rotation
+	// and compression.
+	// (defaults to the SUPERGOOD_OFFLINE_DIR environment variable, or "supergood-events" if not set)
+	OfflineDir string
+
+	// RemoteConfigFile is the path of a JSON file in the format of the remote config served
+	// by the Supergood API, which is read instead of fetching the remote config in offline mode.
+	// New returns an error if the file can not be read.
+	// (by default no endpoints are configured in offline mode)
+	RemoteConfigFile string
+
+	// SpoolDir enables a durable on-disk queue. Events are redacted and appended to
+	// segment files in this directory in the background as they are logged, and removed
+	// once uploaded. Events left over from a previous process, e.g. after a crash, are
+	// uploaded on startup. Events logged just before a crash may not have been written.
+	// (by default events are only held in memory)
+	SpoolDir string
+
+	// RateLimitMaxWait is how long a request to a rate limited endpoint waits for the
+	// rate limit to allow it before it is blocked. Endpoints with the Block action and
+	// a rate limit in the remote config only block requests once the limit is exceeded,
+	// endpoints without a rate limit block every request.
+	// (by default requests are blocked without waiting)
+	RateLimitMaxWait time.Duration
+
+	// BlockWithError makes requests blocked by supergood fail with an error wrapping ErrBlocked,
+	// which can be detected with errors.Is.
+	// (by default blocked requests get a 429 Too Many Requests response with a Retry-After header)
+	BlockWithError bool
+
 	// ProxyHost is the Supergood Proxy Hostname
 	ProxyHost string
 
@@ -104,28 +236,8 @@ func (o *Options) parse() (*Options, error) {
 		o = &copy
 	}
 
-	if o.ClientID == "" {
-		o.ClientID = os.Getenv("SUPERGOOD_CLIENT_ID")
-	}
-	if o.ClientID == "" {
-		return nil, fmt.Errorf("supergood: missing ClientID (SUPERGOOD_CLIENT_ID not in environment)")
-	}
-
-	if o.ClientSecret == "" {
-		o.ClientSecret = os.Getenv("SUPERGOOD_CLIENT_SECRET")
-	}
-	if o.ClientSecret == "" {
-		return nil, fmt.Errorf("supergood: missing ClientSecret (SUPERGOOD_CLIENT_SECRET not in environment)")
-	}
-
-	if o.BaseURL == "" {
-		o.BaseURL = os.Getenv("SUPERGOOD_BASE_URL")
-	}
-	if o.BaseURL == "" {
-		o.BaseURL = "https://api.supergood.ai"
-	}
-	if u, err := url.Parse(o.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
-		return nil, fmt.Errorf("supergood: invalid BaseURL: %w", err)
+	if err := o.parseAPI(!o.Offline); err != nil {
+		return nil, err
 	}
 
 	if o.FlushInterval == 0 {
@@ -135,16 +247,35 @@ func (o *Options) parse() (*Options, error) {
 		return nil, fmt.Errorf("supergood: FlushInterval too small, did you forget to multiply by time.Second?")
 	}
 
-	if o.HTTPClient == nil {
-		o.HTTPClient = http.DefaultClient
-	}
-
 	if o.OnError == nil {
 		o.OnError = func(e error) {
 			fmt.Fprintln(os.Stderr, e)
 		}
 	}
 
+	// a Logger passed by the caller is only filtered if a LogLevel is also set
+	filter := o.Logger == nil || o.LogLevel != ""
+	if o.Logger == nil {
+		if o.LogLevel == "" {
+			o.Logger = discardLogger{}
+		} else {
+			o.Logger = newStderrLogger()
+		}
+	}
+	if o.LogLevel == "" {
+		o.LogLevel = "info"
+	}
+	o.LogLevel = strings.ToLower(o.LogLevel)
+	level, ok := logLevels[o.LogLevel]
+	if !ok {
+		o.Logger.Warn("supergood: unsupported LogLevel, using \"info\"", "logLevel", o.LogLevel)
+		o.LogLevel = "info"
+		level = logLevels[o.LogLevel]
+	}
+	if filter {
+		o.Logger = &levelLogger{level: level, next: o.Logger}
+	}
+
 	if o.RedactRequestHeaderKeys == nil {
 		o.RedactRequestHeaderKeys = map[string][]string{}
 	} else {
@@ -169,6 +300,27 @@ func (o *Options) parse() (*Options, error) {
 		}
 	}
 
+	if o.SampleRate == nil {
+		rate := 1.0
+		o.SampleRate = &rate
+	}
+	if *o.SampleRate < 0 || *o.SampleRate > 1 {
+		return nil, fmt.Errorf("supergood: SampleRate must be between 0 and 1")
+	}
+
+	if o.DomainSampleRates == nil {
+		o.DomainSampleRates = map[string]float64{}
+	} else {
+		rates := map[string]float64{}
+		for k, v := range o.DomainSampleRates {
+			if v < 0 || v > 1 {
+				return nil, fmt.Errorf("supergood: DomainSampleRates for %s must be between 0 and 1", k)
+			}
+			rates[strings.ToLower(k)] = v
+		}
+		o.DomainSampleRates = rates
+	}
+
 	if len(o.AllowedDomains) > 0 {
 		if contains(o.BaseURL, o.AllowedDomains) {
 			return nil, fmt.Errorf("supergood: AllowedDomain can not match BaseURL")
@@ -194,6 +346,54 @@ func (o *Options) parse() (*Options, error) {
 		o.MaxCacheSizeBytes = 100000000 // 100MB
 	}
 
+	if o.OfflineDir == "" {
+		o.OfflineDir = os.Getenv("SUPERGOOD_OFFLINE_DIR")
+	}
+	if o.OfflineDir == "" {
+		o.OfflineDir = "supergood-events"
+	}
+	if len(o.Exporters) == 0 {
+		if o.Offline {
+			o.Exporters = []Exporter{NewFileExporter(FileExporterOptions{Dir: o.OfflineDir})}
+		} else {
+			o.Exporters = []Exporter{&apiExporter{options: o}}
+		}
+	}
+
+	if o.MaxBatchEvents == 0 {
+		o.MaxBatchEvents = 1000
+	}
+	if o.MaxBatchBytes == 0 {
+		o.MaxBatchBytes = 10000000 // 10MB
+	}
+	if o.MaxBatchEvents < 0 || o.MaxBatchBytes < 0 {
+		return nil, fmt.Errorf("supergood: MaxBatchEvents and MaxBatchBytes can not be negative")
+	}
+
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.RetryBackoff == 0 {
+		o.RetryBackoff = time.Second
+	}
+	if o.MaxRetryBackoff == 0 {
+		o.MaxRetryBackoff = 30 * time.Second
+	}
+	if o.RetryBackoff < time.Millisecond || o.MaxRetryBackoff < time.Millisecond {
+		return nil, fmt.Errorf("supergood: RetryBackoff too small, did you forget to multiply by time.Second?")
+	}
+
+	if o.MaxRequestBodyBytes < 0 {
+		return nil, fmt.Errorf("supergood: MaxRequestBodyBytes can not be negative")
+	}
+	if o.MaxResponseBodyBytes < 0 {
+		return nil, fmt.Errorf("supergood: MaxResponseBodyBytes can not be negative")
+	}
+
+	if o.RateLimitMaxWait < 0 {
+		return nil, fmt.Errorf("supergood: RateLimitMaxWait can not be negative")
+	}
+
 	if o.ProxyHost == "" {
 		o.ProxyHost = os.Getenv("SUPERGOOD_PROXY_HOST")
 	}
@@ -211,6 +411,49 @@ func (o *Options) parse() (*Options, error) {
 	return o, nil
 }
 
+// parseAPI sets the defaults of and validates the options used to send requests
+// to the Supergood API. The ClientID and ClientSecret are only required if requireCredentials is set.
+func (o *Options) parseAPI(requireCredentials bool) error {
+	if o.ClientID == "" {
+		o.ClientID = os.Getenv("SUPERGOOD_CLIENT_ID")
+	}
+	if o.ClientID == "" && requireCredentials {
+		return fmt.Errorf("supergood: missing ClientID (SUPERGOOD_CLIENT_ID not in environment)")
+	}
+
+	if o.ClientSecret == "" {
+		o.ClientSecret = os.Getenv("SUPERGOOD_CLIENT_SECRET")
+	}
+	if o.ClientSecret == "" && requireCredentials {
+		return fmt.Errorf("supergood: missing ClientSecret (SUPERGOOD_CLIENT_SECRET not in environment)")
+	}
+
+	if o.BaseURL == "" {
+		o.BaseURL = os.Getenv("SUPERGOOD_BASE_URL")
+	}
+	if o.BaseURL == "" {
+		o.BaseURL = "https://api.supergood.ai"
+	}
+	if u, err := url.Parse(o.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("supergood: invalid BaseURL: %w", err)
+	}
+
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+
+	if o.Compression == "" {
+		o.Compression = "none"
+	}
+	if o.Compression != "none" && o.Compression != "gzip" {
+		return fmt.Errorf("supergood: unsupported Compression %q, must be \"gzip\" or \"none\"", o.Compression)
+	}
+	if o.CompressionMinBytes == 0 {
+		o.CompressionMinBytes = 1024
+	}
+	return nil
+}
+
 func (o *Options) isRequestInAllowedDomains(req *http.Request) (bool, error) {
 	url, err := url.Parse(o.BaseURL)
 	if err != nil {
@@ -30,6 +30,14 @@ func TestOptions_defaults(t *testing.T) {
 	require.Equal(t, o.FlushInterval, 1*time.Second)
 	require.Equal(t, o.HTTPClient, http.DefaultClient)
 	require.False(t, o.DisableDefaultWrappedClient)
+	require.Equal(t, 1.0, *o.SampleRate)
+	require.Equal(t, 1000, o.MaxBatchEvents)
+	require.Equal(t, 10000000, o.MaxBatchBytes)
+	require.Equal(t, 3, o.MaxRetries)
+	require.Equal(t, 1*time.Second, o.RetryBackoff)
+	require.Equal(t, 30*time.Second, o.MaxRetryBackoff)
+	require.Equal(t, "info", o.LogLevel)
+	require.NotNil(t, o.Logger)
 }
 
 func TestOptions_overrides(t *testing.T) {
@@ -75,6 +83,9 @@ func TestOptions_errors(t *testing.T) {
 		{ClientID: "x", ClientSecret: ""},
 		{ClientID: "x", ClientSecret: "x", BaseURL: "oops"},
 		{ClientID: "x", ClientSecret: "x", FlushInterval: 1},
+		{ClientID: "x", ClientSecret: "x", Compression: "brotli"},
+		{ClientID: "x", ClientSecret: "x", SampleRate: rate(1.5)},
+		{ClientID: "x", ClientSecret: "x", DomainSampleRates: map[string]float64{"example.com": -1}},
 	} {
 		_, err := New(o)
 		require.Error(t, err)
@@ -83,3 +94,23 @@ func TestOptions_errors(t *testing.T) {
 	_, err := New(&Options{AllowedDomains: []string{"superbad.ai"}})
 	require.Error(t, err)
 }
+
+func rate(r float64) *float64 {
+	return &r
+}
+
+func TestOptions_logLevel(t *testing.T) {
+	logger := &recordingLogger{}
+	o, err := (&Options{ClientID: "x", ClientSecret: "x", Logger: logger, LogLevel: "verbose"}).parse()
+	require.NoError(t, err)
+	require.Equal(t, "info", o.LogLevel)
+	require.Equal(t, []string{"WARN supergood: unsupported LogLevel, using \"info\""}, logger.messages())
+	o.Logger.Debug("filtered")
+	require.Len(t, logger.messages(), 1)
+
+	logger = &recordingLogger{}
+	o, err = (&Options{ClientID: "x", ClientSecret: "x", Logger: logger}).parse()
+	require.NoError(t, err)
+	o.Logger.Debug("unfiltered")
+	require.Equal(t, []string{"DEBUG unfiltered"}, logger.messages())
+}
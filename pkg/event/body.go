@@ -0,0 +1,192 @@
+package event
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// parseStructuredBody parses form, multipart and XML bodies according to their
+// content type, returning false if the body is of another type or malformed
+func parseStructuredBody(b []byte, contentType string) (any, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil, false
+		}
+		body := map[string]any{}
+		for key, vs := range values {
+			body[key] = formValue(vs)
+		}
+		return body, true
+	case mediaType == "multipart/form-data":
+		body, err := parseMultipart(b, params["boundary"])
+		if err != nil {
+			return nil, false
+		}
+		return body, true
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		body, err := parseXML(b)
+		if err != nil {
+			return nil, false
+		}
+		return body, true
+	default:
+		return nil, false
+	}
+}
+
+// isStructured reports whether bodies of contentType are parsed into fields
+func isStructured(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data",
+		mediaType == "application/xml", mediaType == "text/xml", strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return true
+	default:
+		return false
+	}
+}
+
+// formValue collapses a field with a single value into that value
+func formValue[T any](vs []T) any {
+	if len(vs) == 1 {
+		return vs[0]
+	}
+	values := make([]any, len(vs))
+	for i, v := range vs {
+		values[i] = v
+	}
+	return values
+}
+
+// parseMultipart returns the values of the fields of a multipart form. Files are
+// replaced by their name, content type and size so their contents are not captured.
+func parseMultipart(b []byte, boundary string) (map[string]any, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart body without boundary")
+	}
+	fields := map[string][]any{}
+	reader := multipart.NewReader(bytes.NewReader(b), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if part.FileName() != "" {
+			size, err := io.Copy(io.Discard, part)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = append(fields[name], map[string]any{
+				"filename":    part.FileName(),
+				"contentType": part.Header.Get("Content-Type"),
+				"size":        size,
+			})
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = append(fields[name], string(value))
+	}
+
+	body := map[string]any{}
+	for name, values := range fields {
+		body[name] = formValue(values)
+	}
+	return body, nil
+}
+
+// xmlNode is an element being decoded by parseXML
+type xmlNode struct {
+	name     string
+	attrs    map[string]any
+	children map[string][]any
+	text     strings.Builder
+}
+
+// parseXML converts an XML document into nested maps keyed by element name.
+// Elements with only text become strings, attributes are keyed by @name and the
+// text of elements which also have attributes or children is keyed by #text.
+// Repeated elements become lists.
+func parseXML(b []byte) (map[string]any, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	var stack []*xmlNode
+	var root map[string]any
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, children: map[string][]any{}}
+			for _, attr := range t.Attr {
+				if node.attrs == nil {
+					node.attrs = map[string]any{}
+				}
+				node.attrs["@"+attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, node)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				root = map[string]any{node.name: node.value()}
+				continue
+			}
+			parent := stack[len(stack)-1]
+			parent.children[node.name] = append(parent.children[node.name], node.value())
+		}
+	}
+	if root == nil {
+		return nil, errors.New("xml body without a root element")
+	}
+	return root, nil
+}
+
+func (n *xmlNode) value() any {
+	text := strings.TrimSpace(n.text.String())
+	if n.attrs == nil && len(n.children) == 0 {
+		return text
+	}
+	value := map[string]any{}
+	for key, attr := range n.attrs {
+		value[key] = attr
+	}
+	for name, children := range n.children {
+		value[name] = formValue(children)
+	}
+	if text != "" {
+		value["#text"] = text
+	}
+	return value
+}
@@ -0,0 +1,86 @@
+package event
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrorKind classifies why a request did not get a complete response
+type ErrorKind string
+
+const (
+	ErrorDNS               ErrorKind = "dns"
+	ErrorConnectionRefused ErrorKind = "connection_refused"
+	ErrorTLS               ErrorKind = "tls"
+	ErrorTimeout           ErrorKind = "timeout"
+	ErrorCancelled         ErrorKind = "cancelled"
+	ErrorBodyRead          ErrorKind = "body_read"
+	ErrorBlocked           ErrorKind = "blocked"
+	ErrorCircuitOpen       ErrorKind = "circuit_open"
+	ErrorOther             ErrorKind = "other"
+)
+
+// ResponseError describes the failure of a request, keeping the original message
+type ResponseError struct {
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// NewResponseError classifies err as returned by an http.RoundTripper
+func NewResponseError(err error) *ResponseError {
+	return &ResponseError{Kind: classifyError(err), Message: err.Error()}
+}
+
+// classifyError matches err against the error types of the net, crypto/tls and
+// crypto/x509 packages. The message is only matched as a last resort, for errors
+// which are not exported as types.
+func classifyError(err error) ErrorKind {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var rootsErr x509.SystemRootsError
+	var constraintErr x509.ConstraintViolationError
+	var algorithmErr x509.InsecureAlgorithmError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ErrorTimeout
+		}
+		return ErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		errors.As(err, &rootsErr), errors.As(err, &constraintErr),
+		errors.As(err, &algorithmErr):
+		return ErrorTLS
+	case errors.As(err, &opErr) && (opErr.Op == "remote error" || opErr.Op == "local error"):
+		// crypto/tls reports alerts sent by either side of the handshake with these ops
+		return ErrorTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case strings.Contains(err.Error(), "net/http: request canceled"):
+		// last resort: http.Transport does not export the error returned
+		// when a request is cancelled by an http.Client
+		return ErrorCancelled
+	case strings.Contains(err.Error(), "tls: "):
+		// last resort: other handshake failures are created with errors.New
+		return ErrorTLS
+	default:
+		return ErrorOther
+	}
+}
@@ -8,9 +8,17 @@ import (
 // overridden in tests
 var Clock = time.Now
 
+// NewRequest creates a Request capturing the full body of r
 func NewRequest(id string, r *http.Request) *Request {
+	return NewLimitedRequest(id, r, 0)
+}
+
+// NewLimitedRequest creates a Request capturing at most maxBodyBytes of the body of r.
+// A maxBodyBytes of 0 captures the full body.
+func NewLimitedRequest(id string, r *http.Request, maxBodyBytes int) *Request {
 	var body any
-	body, r.Body = duplicateBody(r.Body)
+	var truncated bool
+	body, r.Body, truncated = duplicateBody(r.Body, maxBodyBytes, r.Header.Get("Content-Type"))
 
 	/*
 		Note: When capturing via EBPF, URL is not successfully populated after response reassembly in func http.ReadRequest.
@@ -36,6 +44,14 @@ func NewRequest(id string, r *http.Request) *Request {
 		Body:        body,
 		RequestedAt: Clock(),
 	}
+	if truncated {
+		req.Truncated = true
+		// the size of the remaining body is only known up front when the content length is set
+		req.OriginalSize = -1
+		if r.ContentLength > 0 {
+			req.OriginalSize = int(r.ContentLength)
+		}
+	}
 
 	return req
 }
@@ -48,6 +64,7 @@ func NewResponse(res *http.Response, err error) *Response {
 			StatusText:  "HTTP ERROR",
 			Body:        err.Error(),
 			RespondedAt: now,
+			Error:       NewResponseError(err),
 		}
 	}
 
@@ -56,7 +73,7 @@ func NewResponse(res *http.Response, err error) *Response {
 	if res.Body == nil {
 		res.Body = http.NoBody
 	} else {
-		body, res.Body = duplicateBody(res.Body)
+		body, res.Body, _ = duplicateBody(res.Body, 0, res.Header.Get("Content-Type"))
 	}
 
 	return &Response{
@@ -67,3 +84,56 @@ func NewResponse(res *http.Response, err error) *Response {
 		Body:        body,
 	}
 }
+
+// NewStreamingResponse creates a Response from the status line and headers of res,
+// and replaces res.Body with a reader that records the body as the caller reads it.
+// At most maxBodyBytes of the body are recorded, or the full body if maxBodyBytes is 0.
+// done is called once with the completed Response when the body has been read to
+// the end, fails, or is closed, with Error set if reading failed. A body closed before
+// it was read to the end is flagged as truncated. RespondedAt on the completed Response
+// is the time the last byte was read.
+func NewStreamingResponse(res *http.Response, maxBodyBytes int, done func(*Response)) *Response {
+	resp := &Response{
+		Headers:     headersToMap(res.Header),
+		Status:      res.StatusCode,
+		StatusText:  res.Status,
+		RespondedAt: Clock(),
+	}
+
+	if res.Body == nil {
+		res.Body = http.NoBody
+		completed := *resp
+		done(&completed)
+		return resp
+	}
+
+	res.Body = &recordingBody{
+		rc:    res.Body,
+		limit: maxBodyBytes,
+		onComplete: func(b []byte, size int, eof bool, err error) {
+			completed := *resp
+			completed.RespondedAt = Clock()
+			if err != nil {
+				completed.Error = &ResponseError{Kind: ErrorBodyRead, Message: err.Error()}
+			}
+			// a body is complete once read to EOF, or once its full content length is read
+			complete := eof || (res.ContentLength >= 0 && int64(size) >= res.ContentLength)
+			if size > len(b) || !complete {
+				completed.Body = parseTruncatedBody(b, res.Header.Get("Content-Type"))
+				completed.Truncated = true
+				completed.OriginalSize = size
+				if !complete {
+					// the rest of the body was not read, so its size is only known from the content length
+					completed.OriginalSize = -1
+					if res.ContentLength > 0 {
+						completed.OriginalSize = int(res.ContentLength)
+					}
+				}
+			} else {
+				completed.Body = parseBody(b, res.Header.Get("Content-Type"))
+			}
+			done(&completed)
+		},
+	}
+	return resp
+}
@@ -0,0 +1,182 @@
+package event
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timings breaks down where the time of a request was spent, in milliseconds.
+// Phases which did not happen, such as DNS lookups and connecting when an idle
+// connection was reused, are left at zero.
+type Timings struct {
+	DNSLookup    float64 `json:"dnsLookup,omitempty"`
+	Connect      float64 `json:"connect,omitempty"`
+	TLSHandshake float64 `json:"tlsHandshake,omitempty"`
+	// TimeToFirstByte is measured from the start of the request, so includes the phases above
+	TimeToFirstByte float64 `json:"timeToFirstByte,omitempty"`
+	// ServerProcessing is the time from the request being written to the first byte
+	// of the response, which is mostly spent by the vendor
+	ServerProcessing float64 `json:"serverProcessing,omitempty"`
+	ConnReused       bool    `json:"connReused"`
+}
+
+// TimingsRecorder records the Timings and remote address of a request from its httptrace hooks
+type TimingsRecorder struct {
+	mutex        sync.Mutex
+	remoteAddr   net.Addr
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	timings      Timings
+}
+
+// WithTimings returns a context which records the Timings and Connection of the request
+// it is used for. Any httptrace.ClientTrace already in ctx is still called.
+func WithTimings(ctx context.Context) (context.Context, *TimingsRecorder) {
+	r := &TimingsRecorder{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.timings.DNSLookup = since(r.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			// with multiple addresses only the first dial is timed
+			if r.connectStart.IsZero() {
+				r.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, _ string, err error) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if err == nil {
+				r.timings.Connect = since(r.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.timings.TLSHandshake = since(r.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.timings.ConnReused = info.Reused
+			if info.Conn != nil {
+				r.remoteAddr = info.Conn.RemoteAddr()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.timings.TimeToFirstByte = since(r.start)
+			if !r.wroteRequest.IsZero() {
+				r.timings.ServerProcessing = since(r.wroteRequest)
+			}
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), r
+}
+
+// Timings returns the timings recorded so far
+func (r *TimingsRecorder) Timings() *Timings {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	timings := r.timings
+	return &timings
+}
+
+func since(start time.Time) float64 {
+	if start.IsZero() {
+		return 0
+	}
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// Connection describes the connection a response was received on
+type Connection struct {
+	// Protocol is the protocol of the response, e.g. HTTP/1.1 or HTTP/2.0
+	Protocol string `json:"protocol,omitempty"`
+	// RemoteIP and RemotePort are the address the connection was made to, which is
+	// the address of the proxy when the request was sent through a proxy
+	RemoteIP   string `json:"remoteIp,omitempty"`
+	RemotePort int    `json:"remotePort,omitempty"`
+	// TLSVersion, CipherSuite and CertificateExpiry are only set for TLS connections.
+	// CertificateExpiry is when the certificate presented by the server expires.
+	TLSVersion        string     `json:"tlsVersion,omitempty"`
+	CipherSuite       string     `json:"cipherSuite,omitempty"`
+	CertificateExpiry *time.Time `json:"certificateExpiry,omitempty"`
+}
+
+// Connection returns the details of the connection resp was received on,
+// or nil if the request failed before connecting
+func (r *TimingsRecorder) Connection(resp *http.Response) *Connection {
+	r.mutex.Lock()
+	remoteAddr := r.remoteAddr
+	r.mutex.Unlock()
+
+	if remoteAddr == nil && resp == nil {
+		return nil
+	}
+	conn := &Connection{}
+	if remoteAddr != nil {
+		if host, port, err := net.SplitHostPort(remoteAddr.String()); err == nil {
+			conn.RemoteIP = host
+			conn.RemotePort, _ = strconv.Atoi(port)
+		}
+	}
+	if resp == nil {
+		return conn
+	}
+	conn.Protocol = resp.Proto
+	if resp.TLS != nil {
+		conn.TLSVersion = tlsVersionName(resp.TLS.Version)
+		conn.CipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		if len(resp.TLS.PeerCertificates) > 0 {
+			expiry := resp.TLS.PeerCertificates[0].NotAfter
+			conn.CertificateExpiry = &expiry
+		}
+	}
+	return conn
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
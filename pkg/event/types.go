@@ -20,6 +20,11 @@ type Request struct {
 	Search      string            `json:"search,omitempty"`
 	Body        any               `json:"body,omitempty"`
 	RequestedAt time.Time         `json:"requestedAt"`
+
+	// Truncated is set when only part of the body was captured.
+	// OriginalSize is the full size of the body, or -1 if it is unknown
+	Truncated    bool `json:"-"`
+	OriginalSize int  `json:"-"`
 }
 
 type Response struct {
@@ -29,11 +34,28 @@ type Response struct {
 	Body        any               `json:"body,omitempty"`
 	RespondedAt time.Time         `json:"respondedAt"`
 	Duration    int               `json:"duration"`
+	Timings     *Timings          `json:"timings,omitempty"`
+	Connection  *Connection       `json:"connection,omitempty"`
+	// Error is set when the request failed, or the body could not be read
+	Error *ResponseError `json:"error,omitempty"`
+
+	// Truncated is set when only part of the body was captured.
+	// OriginalSize is the full size of the body, or -1 if it is unknown
+	Truncated    bool `json:"-"`
+	OriginalSize int  `json:"-"`
 }
 
 type MetaData struct {
 	SensitiveKeys []RedactedKeyMeta `json:"sensitiveKeys"`
 	EndpointId    string            `json:"endpointId"`
+	Truncated     bool              `json:"truncated,omitempty"`
+	OriginalSize  map[string]int    `json:"originalSize,omitempty"`
+	SampleRate    float64           `json:"sampleRate,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	TraceId       string            `json:"traceId,omitempty"`
+	SpanId        string            `json:"spanId,omitempty"`
+	Mocked        bool              `json:"mocked,omitempty"`
+	CircuitOpen   bool              `json:"circuitOpen,omitempty"`
 }
 
 type RedactedKeyMeta struct {
@@ -41,3 +63,16 @@ type RedactedKeyMeta struct {
 	Length  int    `json:"length"`
 	Type    string `json:"type"`
 }
+
+// RecordTruncation flags the event as only containing part of the body at location
+// (e.g. requestBody) and records the original size of the body, if known
+func (m *MetaData) RecordTruncation(location string, originalSize int) {
+	m.Truncated = true
+	if originalSize < 0 {
+		return
+	}
+	if m.OriginalSize == nil {
+		m.OriginalSize = map[string]int{}
+	}
+	m.OriginalSize[location] = originalSize
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	domainutils "github.com/supergoodsystems/supergood-go/internal/domain-utils"
@@ -55,7 +56,7 @@ func headersToMap(h http.Header) map[string]string {
 
 type readCloser struct {
 	c io.ReadCloser
-	r *bytes.Reader
+	r io.Reader
 	e error
 }
 
@@ -70,21 +71,105 @@ func (rc *readCloser) Close() error {
 	return rc.c.Close()
 }
 
-func duplicateBody(r io.ReadCloser) (body any, rc io.ReadCloser) {
+// duplicateBody reads the body and returns a copy parsed according to contentType
+// along with a reader that replays it. When limit is greater than 0, only the first
+// limit bytes are read up front and the returned reader continues from the original
+// body after replaying them.
+func duplicateBody(r io.ReadCloser, limit int, contentType string) (body any, rc io.ReadCloser, truncated bool) {
 	if r == nil {
-		return nil, nil
+		return nil, nil, false
 	}
 
-	b, err := io.ReadAll(r)
-	rc = &readCloser{c: r, r: bytes.NewReader(b), e: err}
+	if limit <= 0 {
+		b, err := io.ReadAll(r)
+		return parseBody(b, contentType), &readCloser{c: r, r: bytes.NewReader(b), e: err}, false
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if len(b) <= limit {
+		return parseBody(b, contentType), &readCloser{c: r, r: bytes.NewReader(b), e: err}, false
+	}
+	return parseTruncatedBody(b[:limit], contentType), &readCloser{c: r, r: io.MultiReader(bytes.NewReader(b), r), e: err}, true
+}
 
+// parseBody parses form, multipart and XML bodies into structured values according to
+// contentType. Other bodies are parsed as JSON, falling back to a string or the raw bytes.
+func parseBody(b []byte, contentType string) any {
+	if body, ok := parseStructuredBody(b, contentType); ok {
+		return body
+	}
 	if !utf8.Valid(b) {
-		body = &b
-	} else {
-		body = map[string]any{}
-		if err := json.Unmarshal(b, &body); err != nil {
-			body = string(b)
-		}
-	}
-	return
+		return &b
+	}
+	var body any = map[string]any{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return string(b)
+	}
+	return body
+}
+
+// parseTruncatedBody parses the start of a body which was cut short. Form, multipart,
+// XML and JSON bodies which no longer parse into fields are omitted rather than captured
+// as text or raw bytes, as the redaction of their fields could not be applied to them.
+func parseTruncatedBody(b []byte, contentType string) any {
+	body := parseBody(b, contentType)
+	if _, ok := body.(map[string]any); !ok && isStructured(contentType) {
+		return nil
+	}
+	return body
+}
+
+// recordingBody passes reads through to the original body while keeping a copy
+// of up to limit bytes read. onComplete is called once, when the body returns EOF or an
+// error, or is closed, with the recorded bytes, the total number of bytes read, whether
+// the body was read to EOF and the error other than EOF returned by the body, if any.
+type recordingBody struct {
+	rc         io.ReadCloser
+	limit      int
+	mutex      sync.Mutex
+	buf        bytes.Buffer
+	size       int
+	eof        bool
+	completed  bool
+	err        error
+	onComplete func(b []byte, size int, eof bool, err error)
+}
+
+func (rb *recordingBody) Read(p []byte) (int, error) {
+	n, err := rb.rc.Read(p)
+	rb.mutex.Lock()
+	recorded := p[:n]
+	if rb.limit > 0 && rb.buf.Len()+n > rb.limit {
+		recorded = recorded[:rb.limit-rb.buf.Len()]
+	}
+	rb.buf.Write(recorded)
+	rb.size += n
+	if err == io.EOF {
+		rb.eof = true
+	} else if err != nil && rb.err == nil {
+		rb.err = err
+	}
+	rb.mutex.Unlock()
+	if err != nil {
+		rb.complete()
+	}
+	return n, err
+}
+
+func (rb *recordingBody) Close() error {
+	err := rb.rc.Close()
+	rb.complete()
+	return err
+}
+
+func (rb *recordingBody) complete() {
+	rb.mutex.Lock()
+	if rb.completed {
+		rb.mutex.Unlock()
+		return
+	}
+	rb.completed = true
+	b, size, eof, err := rb.buf.Bytes(), rb.size, rb.eof, rb.err
+	rb.mutex.Unlock()
+	rb.onComplete(b, size, eof, err)
 }
@@ -34,6 +34,11 @@ func redactAll(domain string, e *event.Event, sensitiveKeys []remoteconfig.Sensi
 	errs = append(errs, err...)
 	meta = append(meta, redactRequestBodyMeta...)
 
+	// requests which are still waiting on a response have nothing more to redact
+	if e.Response == nil {
+		return meta, errs
+	}
+
 	redactResponseHeaderMeta, err := redactAllHelperRecurse(reflect.ValueOf(&e.Response.Headers), shared.ResponseHeadersStr, allowedKeys)
 	errs = append(errs, err...)
 	meta = append(meta, redactResponseHeaderMeta...)
@@ -1,10 +1,13 @@
 package redact
 
 import (
+	"net/http"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/supergoodsystems/supergood-go/pkg/event"
 	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
 )
 
@@ -57,6 +60,34 @@ func Test_Redact_With_Path(t *testing.T) {
 		require.Equal(t, "string", events[0].MetaData.SensitiveKeys[5].Type)
 	})
 
+	t.Run("Redact sensitive key from form encoded request body", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "https://test.com/test-endpoint", strings.NewReader("card_number=4242424242424242&currency=usd"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		events := []*event.Event{{
+			Request:  event.NewRequest("id", req),
+			MetaData: event.MetaData{EndpointId: "endpointId"},
+		}}
+		config := CreateRemoteConfig(false)
+		regex, _ := regexp.Compile("test-endpoint")
+		cacheVal := remoteconfig.EndpointCacheVal{
+			Regex:    *regex,
+			Location: "path",
+			Action:   "Accept",
+			SensitiveKeys: []remoteconfig.SensitiveKeys{
+				{KeyPath: "requestBody.card_number", Action: "REDACT"},
+			},
+		}
+		config.Set("test.com", map[string]remoteconfig.EndpointCacheVal{"endpointId": cacheVal})
+		errors := Redact(events, config)
+
+		require.Len(t, errors, 0)
+		require.Equal(t, nil, events[0].Request.Body.(map[string]any)["card_number"])
+		require.Equal(t, "usd", events[0].Request.Body.(map[string]any)["currency"])
+		require.Equal(t, "requestBody.card_number", events[0].MetaData.SensitiveKeys[0].KeyPath)
+		require.Equal(t, "string", events[0].MetaData.SensitiveKeys[0].Type)
+	})
+
 	t.Run("Redact sensitive key from response body", func(t *testing.T) {
 		events := CreateEvents()
 		config := CreateRemoteConfig(false)
@@ -51,6 +51,23 @@ func (rc *RemoteConfig) SetProxyForHost(host string, val ProxyEnabled) error {
 	return nil
 }
 
+// GetCircuitBreaker returns the circuit breaker configured for a domain, if any
+func (rc *RemoteConfig) GetCircuitBreaker(domain string) *CircuitBreaker {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.circuitBreakers[domain]
+}
+
+func (rc *RemoteConfig) setCircuitBreaker(domain string, val *CircuitBreaker) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if val == nil {
+		delete(rc.circuitBreakers, domain)
+		return
+	}
+	rc.circuitBreakers[domain] = val
+}
+
 func (rc *RemoteConfig) IsInitialized() bool {
 	return rc.initialized
 }
@@ -74,12 +91,18 @@ func (rc *RemoteConfig) Create(remoteConfig *RemoteConfigResponse) error {
 				return err
 			}
 			endpointCacheVal := EndpointCacheVal{
-				Id:            endpoint.Id,
-				Method:        endpoint.Method,
-				Regex:         *regex,
-				Location:      endpoint.MatchingRegex.Location,
-				Action:        endpoint.EndpointConfiguration.Action,
-				SensitiveKeys: rc.mergeSensitiveKeysOptions(config.Domain, endpoint.EndpointConfiguration.SensitiveKeys),
+				Id:                   endpoint.Id,
+				Method:               endpoint.Method,
+				Regex:                *regex,
+				Location:             endpoint.MatchingRegex.Location,
+				Action:               endpoint.EndpointConfiguration.Action,
+				SensitiveKeys:        rc.mergeSensitiveKeysOptions(config.Domain, endpoint.EndpointConfiguration.SensitiveKeys),
+				MaxRequestBodyBytes:  endpoint.EndpointConfiguration.MaxRequestBodyBytes,
+				MaxResponseBodyBytes: endpoint.EndpointConfiguration.MaxResponseBodyBytes,
+				SampleRate:           endpoint.EndpointConfiguration.SampleRate,
+				RateLimit:            endpoint.EndpointConfiguration.RateLimit,
+				MockResponse:         endpoint.EndpointConfiguration.MockResponse,
+				CircuitBreaker:       endpoint.EndpointConfiguration.CircuitBreaker,
 			}
 			cacheVal[endpoint.Id] = endpointCacheVal
 		}
@@ -87,6 +110,7 @@ func (rc *RemoteConfig) Create(remoteConfig *RemoteConfigResponse) error {
 		if err != nil {
 			return err
 		}
+		rc.setCircuitBreaker(config.Domain, config.CircuitBreaker)
 	}
 	for host, proxyConfig := range remoteConfig.ProxyConfig.VendorCredentialConfig {
 		err := rc.SetProxyForHost(host, proxyConfig)
@@ -97,9 +121,11 @@ func (rc *RemoteConfig) Create(remoteConfig *RemoteConfigResponse) error {
 	return nil
 }
 
+// Close stops the refresh loop. It is safe to call more than once.
 func (rc *RemoteConfig) Close() {
-	rc.close <- struct{}{}
-	close(rc.close)
+	rc.closeOnce.Do(func() {
+		close(rc.close)
+	})
 }
 
 func (rc *RemoteConfig) mergeSensitiveKeysOptions(domain string, sensitiveKeys []SensitiveKeys) []SensitiveKeys {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 )
 
 // fetch calls the supergood /v2/config endpoint and returns a marshalled config object
@@ -44,3 +45,25 @@ func (rc *RemoteConfig) fetch() (*RemoteConfigResponse, error) {
 
 	return &remoteConfig, nil
 }
+
+// load reads the remote config from a local file in the /v2/config response format.
+// Without a file an empty config is used, so all requests are logged.
+func (rc *RemoteConfig) load() (*RemoteConfigResponse, error) {
+	if rc.configFile == "" {
+		return &RemoteConfigResponse{}, nil
+	}
+
+	f, err := os.Open(rc.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("supergood: unable to read remote config file: %w", err)
+	}
+	defer f.Close()
+
+	var remoteConfig RemoteConfigResponse
+	err = json.NewDecoder(f).Decode(&remoteConfig)
+	if err != nil {
+		return nil, fmt.Errorf("supergood: invalid remote config file %s: %w", rc.configFile, err)
+	}
+
+	return &remoteConfig, nil
+}
@@ -1,6 +1,9 @@
 package remoteconfig
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 )
 
@@ -10,6 +13,7 @@ func New(opts RemoteConfigOpts) RemoteConfig {
 		baseURL:                 opts.BaseURL,
 		cache:                   map[string]map[string]EndpointCacheVal{},
 		proxyCache:              map[string]*ProxyEnabled{},
+		circuitBreakers:         map[string]*CircuitBreaker{},
 		clientID:                opts.ClientID,
 		clientSecret:            opts.ClientSecret,
 		client:                  opts.Client,
@@ -17,10 +21,13 @@ func New(opts RemoteConfigOpts) RemoteConfig {
 		fetchInterval:           opts.FetchInterval,
 		initialized:             false,
 		handleError:             opts.HandleError,
+		onRefresh:               opts.OnRefresh,
 		redactAll:               opts.RedactAll,
 		redactRequestBodyKeys:   opts.RedactRequestBodyKeys,
 		redactResponseBodyKeys:  opts.RedactResponseBodyKeys,
 		redactRequestHeaderKeys: opts.RedactRequestHeaderKeys,
+		offline:                 opts.Offline,
+		configFile:              opts.ConfigFile,
 	}
 }
 
@@ -46,10 +53,15 @@ func (rc *RemoteConfig) Refresh() {
 	}
 }
 
-// fetchAndSetConfig fetches the remote config from the supergood /v2/config endpoint
-// and then sets it in the Cache on the RemoteConfig
+// fetchAndSetConfig fetches the remote config from the supergood /v2/config endpoint,
+// or the local config file in offline mode, and then sets it in the Cache on the RemoteConfig
 func (rc *RemoteConfig) fetchAndSetConfig() error {
-	resp, err := rc.fetch()
+	start := time.Now()
+	fetch := rc.fetch
+	if rc.offline {
+		fetch = rc.load
+	}
+	resp, err := fetch()
 	if err != nil {
 		return err
 	}
@@ -57,7 +69,30 @@ func (rc *RemoteConfig) fetchAndSetConfig() error {
 	err = rc.Create(resp)
 	if err == nil {
 		rc.initialized = true
+		rc.setVersion(resp)
+		if rc.onRefresh != nil {
+			rc.onRefresh(len(resp.EndpointConfig), time.Since(start))
+		}
 	}
 
 	return err
 }
+
+// Version identifies the contents of the current config, changing only when
+// a refresh returns a different config. It is empty until the config is initialized.
+func (rc *RemoteConfig) Version() string {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.version
+}
+
+func (rc *RemoteConfig) setVersion(resp *RemoteConfigResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(b)
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.version = hex.EncodeToString(sum[:6])
+}
@@ -14,29 +14,38 @@ type RemoteConfigOpts struct {
 	Client                  *http.Client
 	FetchInterval           time.Duration
 	HandleError             func(error)
+	OnRefresh               func(domains int, latency time.Duration)
 	RedactAll               bool
 	RedactRequestBodyKeys   map[string][]string
 	RedactResponseBodyKeys  map[string][]string
 	RedactRequestHeaderKeys map[string][]string
+	Offline                 bool
+	ConfigFile              string
 }
 
 type RemoteConfig struct {
 	baseURL                 string
 	cache                   map[string]map[string]EndpointCacheVal
 	proxyCache              map[string]*ProxyEnabled
+	circuitBreakers         map[string]*CircuitBreaker
 	clientID                string
 	clientSecret            string
 	client                  *http.Client
 	close                   chan struct{}
+	closeOnce               sync.Once
 	fetchInterval           time.Duration
 	initialized             bool
 	handleError             func(error)
+	onRefresh               func(domains int, latency time.Duration)
+	version                 string
 	mutex                   sync.RWMutex
 	proxyMutex              sync.RWMutex
 	redactAll               bool
 	redactRequestBodyKeys   map[string][]string
 	redactResponseBodyKeys  map[string][]string
 	redactRequestHeaderKeys map[string][]string
+	offline                 bool
+	configFile              string
 }
 
 type RemoteConfigResponse struct {
@@ -51,8 +60,9 @@ type ProxyEnabled struct {
 	Enabled bool `json:"enabled"`
 }
 type EndpointConfig struct {
-	Domain    string     `json:"domain"`
-	Endpoints []Endpoint `json:"endpoints"`
+	Domain         string          `json:"domain"`
+	Endpoints      []Endpoint      `json:"endpoints"`
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
 }
 
 type Endpoint struct {
@@ -69,11 +79,44 @@ type MatchingRegex struct {
 }
 
 type EndpointConfiguration struct {
-	Id            string          `json:"id"`
-	Acknowledged  bool            `json:"acknowledged"`
-	Action        string          `json:"action"`
-	UpdatedAt     time.Time       `json:"updatedAt"`
-	SensitiveKeys []SensitiveKeys `json:"sensitiveKeys"`
+	Id                   string          `json:"id"`
+	Acknowledged         bool            `json:"acknowledged"`
+	Action               string          `json:"action"`
+	UpdatedAt            time.Time       `json:"updatedAt"`
+	SensitiveKeys        []SensitiveKeys `json:"sensitiveKeys"`
+	MaxRequestBodyBytes  int             `json:"maxRequestBodyBytes,omitempty"`
+	MaxResponseBodyBytes int             `json:"maxResponseBodyBytes,omitempty"`
+	SampleRate           *float64        `json:"sampleRate,omitempty"`
+	RateLimit            *RateLimit      `json:"rateLimit,omitempty"`
+	MockResponse         *MockResponse   `json:"mockResponse,omitempty"`
+	CircuitBreaker       *CircuitBreaker `json:"circuitBreaker,omitempty"`
+}
+
+// MockResponse is returned instead of calling the vendor for endpoints with the Mock action
+type MockResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// CircuitBreaker stops requests being sent to an endpoint or domain which is failing.
+// The breaker opens after ConsecutiveFailures failed requests in a row, or once ErrorRate
+// of at least MinRequests requests within WindowSeconds have failed. After CooldownSeconds
+// a single request is sent to probe whether the vendor has recovered.
+type CircuitBreaker struct {
+	ConsecutiveFailures int     `json:"consecutiveFailures,omitempty"`
+	ErrorRate           float64 `json:"errorRate,omitempty"`
+	MinRequests         int     `json:"minRequests,omitempty"`
+	WindowSeconds       float64 `json:"windowSeconds,omitempty"`
+	CooldownSeconds     float64 `json:"cooldownSeconds,omitempty"`
+}
+
+// RateLimit limits the requests made to an endpoint with the Block action.
+// Requests are only blocked once the limit is exceeded.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	RequestsPerMinute float64 `json:"requestsPerMinute,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
 }
 
 type SensitiveKeys struct {
@@ -84,10 +127,16 @@ type SensitiveKeys struct {
 }
 
 type EndpointCacheVal struct {
-	Id            string
-	Regex         regexp.Regexp
-	Method        string
-	Location      string
-	Action        string
-	SensitiveKeys []SensitiveKeys
+	Id                   string
+	Regex                regexp.Regexp
+	Method               string
+	Location             string
+	Action               string
+	SensitiveKeys        []SensitiveKeys
+	MaxRequestBodyBytes  int
+	MaxResponseBodyBytes int
+	SampleRate           *float64
+	RateLimit            *RateLimit
+	MockResponse         *MockResponse
+	CircuitBreaker       *CircuitBreaker
 }
@@ -0,0 +1,143 @@
+package supergood
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
+)
+
+// bucketSweepInterval is how often buckets which have refilled are removed
+const bucketSweepInterval = time.Minute
+
+// rateLimiter keeps a token bucket for each rate limited endpoint
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+// Tokens go negative when requests wait for a token which has not yet been refilled.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}, swept: time.Now()}
+}
+
+// refill adds the tokens accumulated since the bucket was last used
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes a token from the bucket of an endpoint, returning how long to wait
+// before it is available. If the wait would be longer than maxWait no token is
+// taken and false is returned along with the wait.
+func (l *rateLimiter) reserve(endpointId string, limit *remoteconfig.RateLimit, maxWait time.Duration) (time.Duration, bool) {
+	rate := limit.RequestsPerSecond
+	if rate <= 0 {
+		rate = limit.RequestsPerMinute / 60
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if rate <= 0 {
+		return 0, false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	bucket, ok := l.buckets[endpointId]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[endpointId] = bucket
+	}
+	// the limit may have changed since the remote config was refreshed
+	bucket.rate = rate
+	bucket.burst = burst
+
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	bucket.tokens--
+	return wait, true
+}
+
+// cancel returns a token taken by reserve to the bucket of an endpoint,
+// for a request which gave up waiting for it
+func (l *rateLimiter) cancel(endpointId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if bucket, ok := l.buckets[endpointId]; ok {
+		bucket.refill(time.Now())
+		bucket.tokens++
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+	}
+}
+
+// sweep removes the buckets which have refilled, as they are the same as a new bucket,
+// so endpoints which are no longer called or configured do not keep a bucket.
+// l.mutex must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < bucketSweepInterval {
+		return
+	}
+	l.swept = now
+	for endpointId, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.buckets, endpointId)
+		}
+	}
+}
+
+// shouldBlock reports whether a request to an endpoint with the Block action is blocked,
+// and when it could be retried. Endpoints without a rate limit block every request until
+// the remote config changes. Otherwise requests are only blocked once the limit is
+// exceeded, after waiting up to RateLimitMaxWait for the limit to allow them.
+func (sg *Service) shouldBlock(req *http.Request, endpoint *remoteconfig.EndpointCacheVal) (bool, time.Duration, error) {
+	if endpoint == nil || endpoint.RateLimit == nil {
+		return true, sg.options.RemoteConfigFetchInterval, nil
+	}
+
+	wait, ok := sg.limiter.reserve(endpoint.Id, endpoint.RateLimit, sg.options.RateLimitMaxWait)
+	if !ok {
+		return true, wait, nil
+	}
+	if wait <= 0 {
+		return false, 0, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false, 0, nil
+	case <-req.Context().Done():
+		sg.limiter.cancel(endpoint.Id)
+		return false, 0, req.Context().Err()
+	}
+}
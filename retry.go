@@ -0,0 +1,207 @@
+package supergood
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/supergoodsystems/supergood-go/pkg/event"
+)
+
+// retryBatch is a batch of redacted events waiting to be sent to an exporter
+type retryBatch struct {
+	exporter Exporter
+	events   []*event.Event
+	size     int
+	attempts int
+	retryAt  time.Time
+	// segment is the spool segment holding the events, which is removed
+	// once every batch from it has been uploaded or dropped
+	segment *spoolSegment
+}
+
+// spoolSegment is a sealed spool segment shared by the batches split from one flush
+type spoolSegment struct {
+	path    string
+	mutex   sync.Mutex
+	pending int
+	keep    bool
+}
+
+// release marks one of the batches from the segment as settled, and reports whether
+// the segment can be removed. Segments are kept if any of their batches should be
+// uploaded when the service next starts.
+func (s *spoolSegment) release(keep bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending--
+	s.keep = s.keep || keep
+	return s.pending == 0 && !s.keep
+}
+
+// splitBatches splits events into batches of at most MaxBatchEvents events
+// and MaxBatchBytes bytes for each exporter. An event larger than MaxBatchBytes
+// is sent on its own.
+func (sg *Service) splitBatches(events []*event.Event, sealed string) []*retryBatch {
+	var segment *spoolSegment
+	if sealed != "" {
+		segment = &spoolSegment{path: sealed}
+	}
+
+	batches := []*retryBatch{}
+	for _, exporter := range sg.options.Exporters {
+		batch := &retryBatch{exporter: exporter, segment: segment}
+		for _, entry := range events {
+			full := len(batch.events) >= sg.options.MaxBatchEvents || batch.size+entry.Size > sg.options.MaxBatchBytes
+			if len(batch.events) > 0 && full {
+				batches = append(batches, batch)
+				batch = &retryBatch{exporter: exporter, segment: segment}
+			}
+			batch.events = append(batch.events, entry)
+			batch.size += entry.Size
+		}
+		batches = append(batches, batch)
+	}
+
+	if segment != nil {
+		segment.pending = len(batches)
+	}
+	return batches
+}
+
+// dueRetries removes and returns the batches that are ready to be retried,
+// or every batch if force is set. sg.mutex must be held.
+func (sg *Service) dueRetries(force bool) []*retryBatch {
+	now := time.Now()
+	due := []*retryBatch{}
+	pending := []*retryBatch{}
+	for _, batch := range sg.retries {
+		if force || !now.Before(batch.retryAt) {
+			sg.size -= batch.size
+			due = append(due, batch)
+		} else {
+			pending = append(pending, batch)
+		}
+	}
+	sg.retries = pending
+	return due
+}
+
+// upload sends a batch of events to its exporter. If the export fails with a retryable
+// error the batch is queued to be retried after a backoff, otherwise it is dropped.
+// On the final flush failed batches are not retried, but spooled batches are left
+// on disk to be exported when the service next starts.
+func (sg *Service) upload(ctx context.Context, batch *retryBatch, final bool) error {
+	start := time.Now()
+	err := batch.exporter.Export(ctx, batch.events)
+	if err == nil {
+		sg.options.Logger.Debug("supergood: exported batch", "events", len(batch.events), "bytes", batch.size, "attempts", batch.attempts+1, "latency", time.Since(start))
+		sg.releaseSegment(batch.segment, false)
+		return nil
+	}
+
+	batch.attempts++
+	sg.options.Logger.Warn("supergood: export failed", "events", len(batch.events), "bytes", batch.size, "attempts", batch.attempts, "error", err)
+	if final {
+		if batch.segment == nil {
+			sg.drop(batch, dropExportFailed, err)
+		}
+		sg.releaseSegment(batch.segment, true)
+		return err
+	}
+	if !isRetryable(err) || batch.attempts > sg.options.MaxRetries {
+		sg.drop(batch, dropExportFailed, err)
+		sg.releaseSegment(batch.segment, false)
+		return err
+	}
+
+	batch.retryAt = time.Now().Add(sg.retryBackoff(batch.attempts, err))
+	sg.mutex.Lock()
+	if sg.size+batch.size > sg.options.MaxCacheSizeBytes {
+		sg.mutex.Unlock()
+		sg.drop(batch, dropCacheFull, fmt.Errorf("supergood: cache is full, unable to retry upload: %w", err))
+		sg.releaseSegment(batch.segment, false)
+		return err
+	}
+	sg.size += batch.size
+	sg.retries = append(sg.retries, batch)
+	sg.mutex.Unlock()
+	return err
+}
+
+// retryBackoff returns the delay before the next attempt to upload a batch:
+// an exponential backoff with jitter, or the Retry-After sent by the API if longer
+func (sg *Service) retryBackoff(attempts int, err error) time.Duration {
+	backoff := sg.options.RetryBackoff
+	for i := 1; i < attempts && backoff < sg.options.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > sg.options.MaxRetryBackoff {
+		backoff = sg.options.MaxRetryBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	var pe *postError
+	if errors.As(err, &pe) && pe.retryAfter > backoff {
+		backoff = pe.retryAfter
+	}
+	var re *RetryableError
+	if errors.As(err, &re) && re.RetryAfter > backoff {
+		backoff = re.RetryAfter
+	}
+	return backoff
+}
+
+func (sg *Service) drop(batch *retryBatch, reason string, err error) {
+	sg.metrics.recordDropped(reason, len(batch.events))
+	sg.options.Logger.Warn("supergood: dropped events", "events", len(batch.events), "bytes", batch.size, "reason", reason, "error", err)
+	if sg.options.OnDrop != nil {
+		sg.options.OnDrop(batch.events, err)
+	}
+}
+
+// releaseSegment settles a batch uploaded from a spool segment,
+// removing the segment once all of its batches are settled
+func (sg *Service) releaseSegment(segment *spoolSegment, keep bool) {
+	if sg.spool == nil || segment == nil || !segment.release(keep) {
+		return
+	}
+	if err := sg.spool.Commit(segment.path); err != nil {
+		sg.handleError(err)
+	}
+}
+
+// isRetryable reports whether an upload failed due to the network, a server
+// error or rate limiting, or the exporter marked the error as retryable
+func isRetryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	var pe *postError
+	if errors.As(err, &pe) {
+		return pe.statusCode == http.StatusTooManyRequests || pe.statusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// parseRetryAfter parses a Retry-After header in either delay-seconds or HTTP date form
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
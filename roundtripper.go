@@ -1,23 +1,33 @@
 package supergood
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/supergoodsystems/supergood-go/pkg/event"
+	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
 )
 
+// ErrBlocked is wrapped by the error returned for requests blocked by supergood
+// when BlockWithError is set
+var ErrBlocked = errors.New("supergood: request blocked")
+
 type roundTripper struct {
 	sg   *Service
 	next http.RoundTripper
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	endpoint, errors := rt.sg.RemoteConfig.MatchRequestAgainstEndpoints(req)
-	for _, err := range errors {
-		rt.sg.handleError(err)
-	}
+	endpoint := rt.sg.matchEndpoint(req)
 
 	endpointId := ""
 	endpointAction := "Accept"
@@ -28,59 +38,211 @@ func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 		endpointAction = endpoint.Action
 	}
 
-	if !rt.shouldLogRequest(req, endpointAction) {
+	if !rt.sg.shouldLogRequest(req, endpointAction) {
 		if shouldProxy {
 			rt.proxyRequest(req)
 		}
 		return rt.next.RoundTrip(req)
 	}
 
+	blocked := false
+	var retryAfter time.Duration
+	if endpointAction == "Block" {
+		var err error
+		blocked, retryAfter, err = rt.sg.shouldBlock(req, endpoint)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	// the vendor is not called for mocked endpoints
+	mocked := endpointAction == "Mock" && endpoint.MockResponse != nil
+
+	// requests are rejected without being sent while the circuit breaker is open
+	var breaker *breakerGuard
+	var rejected error
+	if !blocked && !mocked {
+		breaker = rt.sg.circuitBreaker(req, endpoint)
+		if breaker != nil {
+			rejected = breaker.allow()
+		}
+	}
+
+	req, span := rt.sg.startSpan(req, endpointId, endpointAction)
+
+	// requests which are not sampled are still captured when errors are kept,
+	// and dropped once their response turns out to be successful
+	sampleRate, sampled := rt.sg.sampleRequest(req, endpoint)
+	if !sampled && !rt.sg.options.KeepErrors && !blocked && !mocked {
+		rt.sg.metrics.recordDropped(dropSampled, 1)
+		if rejected != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			endSpan(span, nil, rejected)
+			return nil, rejected
+		}
+		if shouldProxy {
+			rt.proxyRequest(req)
+		}
+		resp, err := rt.next.RoundTrip(req)
+		if breaker != nil {
+			breaker.record(req, resp, err)
+		}
+		endSpan(span, resp, err)
+		return resp, err
+	}
+
+	maxRequestBodyBytes, maxResponseBodyBytes := rt.sg.bodyLimits(endpoint)
 	id := uuid.New().String()
-	logged := rt.sg.LogRequest(id, event.NewRequest(id, req), endpointId)
+	logged := false
+	if sampled || rt.sg.options.KeepErrors {
+		meta := event.MetaData{
+			EndpointId: endpointId,
+			SampleRate: sampleRate,
+			Tags:       tagsFromContext(req.Context()),
+			Mocked:     mocked,
+		}
+		meta.CircuitOpen = rejected != nil
+		meta.TraceId, meta.SpanId = traceIDs(req)
+		logged = rt.sg.logRequest(id, event.NewLimitedRequest(id, req, maxRequestBodyBytes), meta, sampled)
+	}
 
 	var resp *http.Response
 	var err error
-	if endpointAction == "Block" {
-		resp = &http.Response{
-			Status:     "Blocked by Supergood: Too many requests",
-			StatusCode: 429,
+	var recorder *event.TimingsRecorder
+	if blocked {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		resp = blockedResponse(req, endpointId, retryAfter)
+		if rt.sg.options.BlockWithError {
+			err = fmt.Errorf("%w by endpoint %s, retry after %v", ErrBlocked, endpointId, retryAfter)
+		}
+	} else if mocked {
+		if req.Body != nil {
+			req.Body.Close()
 		}
+		resp = mockResponse(req, endpoint.MockResponse)
+	} else if rejected != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		err = rejected
 	} else {
 		if shouldProxy {
 			rt.proxyRequest(req)
 		}
+		if logged {
+			var ctx context.Context
+			ctx, recorder = event.WithTimings(req.Context())
+			req = req.WithContext(ctx)
+		}
 		resp, err = rt.next.RoundTrip(req)
+		if breaker != nil {
+			breaker.record(req, resp, err)
+		}
 	}
+	endSpan(span, resp, err)
 
-	if logged {
-		rt.sg.LogResponse(id, event.NewResponse(resp, err))
+	if blocked || mocked {
+		if logged {
+			synthetic := event.NewResponse(resp, nil)
+			if blocked {
+				synthetic.Error = &event.ResponseError{Kind: event.ErrorBlocked, Message: "Blocked by Supergood: Too many requests"}
+			}
+			rt.sg.LogResponse(id, synthetic)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if logged {
+		var timings *event.Timings
+		var conn *event.Connection
+		if recorder != nil {
+			timings = recorder.Timings()
+			conn = recorder.Connection(resp)
+		}
+		if err != nil {
+			failed := event.NewResponse(resp, err)
+			failed.Timings = timings
+			failed.Connection = conn
+			if rejected != nil {
+				failed.Error.Kind = event.ErrorCircuitOpen
+			} else if deadline, ok := req.Context().Deadline(); ok && failed.Error.Kind == event.ErrorCancelled && !time.Now().Before(deadline) {
+				// http.Client cancels requests when its Timeout expires
+				failed.Error.Kind = event.ErrorTimeout
+			}
+			rt.sg.LogResponse(id, failed)
+		} else if !sampled && isSuccess(resp.StatusCode) {
+			// a request which was not sampled is dropped as soon as it succeeds,
+			// without capturing the response body
+			rt.sg.LogResponse(id, &event.Response{Status: resp.StatusCode})
+		} else {
+			// the event is completed once the caller has finished reading the body
+			partial := event.NewStreamingResponse(resp, maxResponseBodyBytes, func(completed *event.Response) {
+				completed.Timings = timings
+				completed.Connection = conn
+				rt.sg.LogResponse(id, completed)
+			})
+			partial.Timings = timings
+			partial.Connection = conn
+			rt.sg.logStreamingResponse(id, partial)
+		}
 	}
 
 	return resp, err
 }
 
-func (rt *roundTripper) shouldLogRequest(req *http.Request, endpointAction string) bool {
-	if !rt.sg.RemoteConfig.IsInitialized() {
-		return false
+// blockedResponse builds the 429 response returned for a blocked request
+func blockedResponse(req *http.Request, endpointId string, retryAfter time.Duration) *http.Response {
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
 	}
+	body, _ := json.Marshal(map[string]any{
+		"error":      "Blocked by Supergood: Too many requests",
+		"endpointId": endpointId,
+		"retryAfter": retryAfterSeconds,
+	})
 
-	allowed, err := rt.sg.options.isRequestInAllowedDomains(req)
-	if err != nil {
-		rt.sg.handleError(err)
-	}
-	if !allowed {
-		return false
-	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	header.Set("X-Supergood-Blocked", "true")
+	return syntheticResponse(req, http.StatusTooManyRequests, "Blocked by Supergood: Too many requests", header, body)
+}
 
-	if endpointAction == "Ignore" {
-		return false
+// mockResponse builds the response configured for a mocked endpoint
+func mockResponse(req *http.Request, mock *remoteconfig.MockResponse) *http.Response {
+	status := mock.Status
+	if status == 0 {
+		status = http.StatusOK
 	}
-
-	if rt.sg.options.SelectRequests != nil {
-		return rt.sg.options.SelectRequests(req)
+	header := http.Header{}
+	for key, value := range mock.Headers {
+		header.Set(key, value)
 	}
+	header.Set("X-Supergood-Mocked", "true")
+	return syntheticResponse(req, status, http.StatusText(status), header, []byte(mock.Body))
+}
 
-	return true
+// syntheticResponse builds a complete response to req which was not sent to the vendor
+func syntheticResponse(req *http.Request, status int, reason string, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, reason),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
 }
 
 func (rt *roundTripper) proxyRequest(req *http.Request) {
@@ -0,0 +1,38 @@
+package supergood
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+
+	domainutils "github.com/supergoodsystems/supergood-go/internal/domain-utils"
+	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
+)
+
+// overridden in tests
+var random = rand.Float64
+
+// sampleRequest returns the sample rate that applies to a request and whether the
+// request is sampled. The sample rate of the matched endpoint takes precedence over
+// DomainSampleRates, which takes precedence over SampleRate.
+func (sg *Service) sampleRequest(req *http.Request, endpoint *remoteconfig.EndpointCacheVal) (float64, bool) {
+	rate := *sg.options.SampleRate
+	host := strings.ToLower(req.URL.Hostname())
+	if domainRate, ok := sg.options.DomainSampleRates[host]; ok {
+		rate = domainRate
+	} else if domainRate, ok := sg.options.DomainSampleRates[domainutils.GetDomainFromHost(host)]; ok {
+		rate = domainRate
+	}
+	if endpoint != nil && endpoint.SampleRate != nil {
+		rate = *endpoint.SampleRate
+	}
+
+	if rate >= 1 {
+		return 1, true
+	}
+	return rate, random() < rate
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status <= 299
+}
@@ -0,0 +1,77 @@
+package supergood
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of the state of a Service, returned by [Service.Stats]
+type Stats struct {
+	// QueuedEvents is the number of events waiting to be flushed,
+	// including requests which have no response yet
+	QueuedEvents int
+	// InFlightRequests is the number of queued requests which have no response yet
+	InFlightRequests int
+	// RetryingEvents is the number of events waiting to be retried after a failed export
+	RetryingEvents int
+	// CacheSizeBytes is the size of the queued and retrying events, which is
+	// limited to MaxCacheSizeBytes
+	CacheSizeBytes    int
+	MaxCacheSizeBytes int
+
+	// CapturedEvents is the number of requests captured since the service started
+	CapturedEvents int
+	// DroppedEvents is the number of events dropped since the service started, by reason:
+	// "cache_full", "export_failed" or "sampled"
+	DroppedEvents map[string]int
+
+	// LastFlush is when events were last flushed, and LastFlushError
+	// the error it returned, if any
+	LastFlush      time.Time
+	LastFlushError error
+
+	// RemoteConfigInitialized is set once the remote config has been fetched
+	RemoteConfigInitialized bool
+	// RemoteConfigVersion identifies the contents of the remote config
+	RemoteConfigVersion string
+	// RemoteConfigAge is the time since the remote config was last refreshed
+	// (zero if it has not been fetched)
+	RemoteConfigAge time.Duration
+}
+
+// Stats returns a snapshot of the state of the service, such as the size of its
+// queue and the result of the last flush, e.g. for use in readiness checks
+func (sg *Service) Stats() Stats {
+	stats := Stats{
+		MaxCacheSizeBytes:       sg.options.MaxCacheSizeBytes,
+		RemoteConfigInitialized: sg.RemoteConfig.IsInitialized(),
+		RemoteConfigVersion:     sg.RemoteConfig.Version(),
+	}
+
+	sg.mutex.Lock()
+	stats.QueuedEvents = len(sg.queue)
+	for _, entry := range sg.queue {
+		if entry.Response == nil {
+			stats.InFlightRequests++
+		}
+	}
+	for _, batch := range sg.retries {
+		stats.RetryingEvents += len(batch.events)
+	}
+	stats.CacheSizeBytes = sg.size
+	sg.mutex.Unlock()
+
+	m := sg.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats.CapturedEvents = m.captured
+	stats.DroppedEvents = map[string]int{}
+	for reason, count := range m.dropped {
+		stats.DroppedEvents[reason] = count
+	}
+	stats.LastFlush = m.lastFlush
+	stats.LastFlushError = m.lastFlushErr
+	if !m.configRefreshed.IsZero() {
+		stats.RemoteConfigAge = time.Since(m.configRefreshed)
+	}
+	return stats
+}
@@ -9,23 +9,29 @@ package supergood
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"runtime/debug"
 	"strings"
 	"time"
 
+	"github.com/supergoodsystems/supergood-go/internal/shared"
+	"github.com/supergoodsystems/supergood-go/internal/spool"
 	"github.com/supergoodsystems/supergood-go/pkg/event"
 	"github.com/supergoodsystems/supergood-go/pkg/redact"
 	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
 )
 
 // New creates a new supergood service.
-// An error is returned only if the configuration is invalid.
+// An error is returned only if the configuration is invalid, or in offline
+// mode if RemoteConfigFile can not be read.
 func New(o *Options) (*Service, error) {
 	o, err := o.parse()
 	if err != nil {
@@ -33,9 +39,16 @@ func New(o *Options) (*Service, error) {
 	}
 
 	sg := &Service{
-		options: o,
-		close:   make(chan chan error),
+		options:  o,
+		stop:     make(chan context.Context, 1),
+		done:     make(chan struct{}),
+		flushing: make(chan struct{}, 1),
+		metrics:  newMetrics(),
+		limiter:  newRateLimiter(),
+		breakers: newCircuitBreakers(),
 	}
+	// periodic flushes are cancelled once Shutdown gives up
+	sg.lifetime, sg.cancel = context.WithCancel(context.Background())
 
 	client := http.DefaultClient
 	if sg.options.HTTPClient != nil {
@@ -57,16 +70,36 @@ func New(o *Options) (*Service, error) {
 		ClientSecret:            sg.options.ClientSecret,
 		Client:                  sg.options.HTTPClient,
 		FetchInterval:           sg.options.RemoteConfigFetchInterval,
-		HandleError:             sg.options.OnError,
+		HandleError:             sg.remoteConfigFailed,
+		OnRefresh:               sg.remoteConfigRefreshed,
 		RedactAll:               sg.options.ForceRedactAll,
 		RedactRequestBodyKeys:   sg.options.RedactRequestBodyKeys,
 		RedactResponseBodyKeys:  sg.options.RedactResponseBodyKeys,
 		RedactRequestHeaderKeys: sg.options.RedactRequestHeaderKeys,
+		Offline:                 sg.options.Offline,
+		ConfigFile:              sg.options.RemoteConfigFile,
 	})
 
 	sg.reset()
+	if sg.options.SpoolDir != "" {
+		s, err := spool.Open(sg.options.SpoolDir)
+		if err != nil {
+			return nil, err
+		}
+		sg.spool = spool.NewWriter(s, sg.redactSnapshot, sg.handleError)
+		sg.recoverSpool()
+	}
+
 	err = sg.RemoteConfig.Init()
+	if err != nil && sg.options.Offline {
+		// without the local config events could not be redacted
+		if sg.spool != nil {
+			sg.spool.Close()
+		}
+		return nil, err
+	}
 	if err != nil {
+		sg.metrics.recordConfigFailure()
 		sg.handleError(err)
 	}
 
@@ -91,29 +124,92 @@ func (sg *Service) Wrap(client *http.Client) *http.Client {
 }
 
 // Close sends any pending requests to supergood
-// and shuts down the service.
+// and shuts down the service. It waits for the upload to complete,
+// use Shutdown to give up after a deadline.
 func (sg *Service) Close() error {
-	ch := make(chan error)
-	sg.close <- ch
-	close(sg.close)
-	sg.RemoteConfig.Close()
-	return <-ch
+	return sg.Shutdown(context.Background())
+}
+
+// Shutdown sends any pending requests to supergood and shuts down the service.
+// Requests made once Shutdown is called are passed through without being logged.
+// If ctx is done before the upload completes Shutdown returns with the number of
+// events which have not been sent, and the upload is cancelled.
+// It is safe to call Shutdown and Close more than once, each returns the result
+// of the first shutdown.
+func (sg *Service) Shutdown(ctx context.Context) error {
+	sg.stopOnce.Do(func() {
+		sg.stop <- ctx
+	})
+
+	select {
+	case <-sg.done:
+		return sg.closeErr
+	case <-ctx.Done():
+		sg.cancel()
+		return fmt.Errorf("supergood: shutdown gave up with %d events unsent: %w", sg.unsent(), ctx.Err())
+	}
+}
+
+// Flush sends the requests which have completed to supergood, waiting for any
+// flush already in progress. Requests still waiting on a response are sent by a
+// later flush. Events which fail to send are retried if possible.
+func (sg *Service) Flush(ctx context.Context) error {
+	select {
+	case sg.flushing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-sg.flushing }()
+
+	select {
+	case <-sg.done:
+		return fmt.Errorf("supergood: service is closed")
+	default:
+	}
+
+	start := time.Now()
+	err := sg.flush(ctx, false)
+	sg.metrics.recordFlush(time.Since(start), err)
+	return err
 }
 
 func (sg *Service) LogRequest(id string, req *event.Request, endpointId string) bool {
+	return sg.logRequest(id, req, event.MetaData{EndpointId: endpointId, SampleRate: 1}, true)
+}
+
+// logRequest queues a request with the given metadata. Requests which were not
+// sampled are only kept if their response is an error.
+func (sg *Service) logRequest(id string, req *event.Request, meta event.MetaData, sampled bool) bool {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
 
+	// requests made once the service is shutting down would never be sent
+	if sg.closed {
+		return false
+	}
+
 	bytes, err := json.Marshal(req)
 	if err != nil {
 		return false
 	}
 	requestSize := len(bytes)
 	if sg.size+requestSize > sg.options.MaxCacheSizeBytes {
+		sg.metrics.recordDropped(dropCacheFull, 1)
 		return false
 	}
 	sg.size += requestSize
-	sg.queue[id] = &event.Event{Request: req, MetaData: event.MetaData{EndpointId: endpointId}, Size: requestSize}
+	entry := &event.Event{Request: req, MetaData: meta, Size: requestSize}
+	if req.Truncated {
+		entry.MetaData.RecordTruncation(shared.RequestBodyStr, req.OriginalSize)
+	}
+	sg.queue[id] = entry
+	if sampled {
+		sg.appendToSpool(entry)
+	} else {
+		// requests which were not sampled are only spooled once they are known to be kept
+		sg.unsampled[id] = struct{}{}
+	}
+	sg.metrics.recordCaptured()
 	return true
 }
 
@@ -126,11 +222,53 @@ func (sg *Service) LogResponse(id string, resp *event.Response) {
 		return
 	}
 	responseSize := len(bytes)
+	_, unsampled := sg.unsampled[id]
+	delete(sg.unsampled, id)
 	if entry, ok := sg.queue[id]; ok {
+		if sg.options.KeepErrors && !isSuccess(resp.Status) {
+			// every error is kept, so errors are not extrapolated by the sample rate
+			entry.MetaData.SampleRate = 1
+		} else if unsampled {
+			sg.size -= entry.Size
+			delete(sg.queue, id)
+			delete(sg.streaming, id)
+			sg.metrics.recordDropped(dropSampled, 1)
+			return
+		}
 		entry.Response = resp
 		entry.Response.Duration = int(entry.Response.RespondedAt.Sub(entry.Request.RequestedAt) / time.Millisecond)
+		if resp.Truncated {
+			entry.MetaData.RecordTruncation(shared.ResponseBodyStr, resp.OriginalSize)
+		}
 		entry.Size += responseSize
 		sg.size += responseSize
+		sg.appendToSpool(entry)
+	}
+	delete(sg.streaming, id)
+}
+
+// discardRequest removes a queued request which will not get a response to capture
+func (sg *Service) discardRequest(id string) {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	if entry, ok := sg.queue[id]; ok {
+		sg.size -= entry.Size
+		delete(sg.queue, id)
+	}
+	delete(sg.streaming, id)
+	delete(sg.unsampled, id)
+}
+
+// logStreamingResponse records the status and headers of a response whose body
+// is still being read. It is only sent to supergood if the service is closed
+// before the body completes and LogResponse is called.
+func (sg *Service) logStreamingResponse(id string, resp *event.Response) {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+
+	if entry, ok := sg.queue[id]; ok && entry.Response == nil {
+		sg.streaming[id] = resp
 	}
 }
 
@@ -139,18 +277,19 @@ func (sg *Service) GetSelectedRequests(req *http.Request) bool {
 }
 
 func (sg *Service) loop() {
-	var closed chan error
 	for {
 		select {
-		case closed = <-sg.close:
-			err := sg.flush(true)
-			if err != nil {
-				sg.handleError(err)
-			}
-			closed <- err
+		case ctx := <-sg.stop:
+			sg.closeErr = sg.shutdown(ctx)
+			sg.cancel()
+			close(sg.done)
 			return
 		case <-time.After(sg.options.FlushInterval):
-			err := sg.flush(false)
+			sg.flushing <- struct{}{}
+			start := time.Now()
+			err := sg.flush(sg.lifetime, false)
+			sg.metrics.recordFlush(time.Since(start), err)
+			<-sg.flushing
 			if err != nil {
 				sg.handleError(err)
 			}
@@ -158,45 +297,196 @@ func (sg *Service) loop() {
 	}
 }
 
-func (sg *Service) flush(force bool) error {
+// shutdown flushes every pending event and releases the resources of the service
+func (sg *Service) shutdown(ctx context.Context) error {
+	sg.mutex.Lock()
+	sg.closed = true
+	sg.mutex.Unlock()
+
+	sg.flushing <- struct{}{}
+	defer func() { <-sg.flushing }()
+
+	start := time.Now()
+	err := sg.flush(ctx, true)
+	sg.metrics.recordFlush(time.Since(start), err)
+	if err != nil {
+		sg.handleErrorContext(ctx, err)
+	}
+
+	sg.RemoteConfig.Close()
+	if sg.spool != nil {
+		if spoolErr := sg.spool.Close(); spoolErr != nil {
+			sg.handleErrorContext(ctx, spoolErr)
+		}
+	}
+	for _, exporter := range sg.options.Exporters {
+		if closer, ok := exporter.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// unsent counts the events which have not yet been exported
+func (sg *Service) unsent() int {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
+	unsent := len(sg.queue) + len(sg.recovered) + sg.exporting
+	for _, batch := range sg.retries {
+		unsent += len(batch.events)
+	}
+	return unsent
+}
 
+func (sg *Service) flush(ctx context.Context, force bool) error {
+	start := time.Now()
+	sg.mutex.Lock()
 	cacheSize := sg.size
-	toSend := []*event.Event{}
+	toSend := sg.recovered
+	sg.recovered = nil
+	for _, entry := range toSend {
+		sg.size -= entry.Size
+	}
+	recovered := len(toSend)
 	queueLen := len(sg.queue)
 	for key, entry := range sg.queue {
-		if entry.Response == nil && !force {
-			continue
+		if entry.Response == nil {
+			if !force {
+				continue
+			}
+			if _, ok := sg.unsampled[key]; ok {
+				// the outcome of a request which was not sampled is unknown, so it is not sent
+				sg.size -= entry.Size
+				delete(sg.queue, key)
+				delete(sg.streaming, key)
+				delete(sg.unsampled, key)
+				sg.metrics.recordDropped(dropSampled, 1)
+				continue
+			}
+			if resp, ok := sg.streaming[key]; ok {
+				entry.Response = resp
+				entry.Response.Duration = int(resp.RespondedAt.Sub(entry.Request.RequestedAt) / time.Millisecond)
+			}
 		}
 		sg.size -= entry.Size
 		if sg.size < 0 {
-			sg.handleError(errors.New("unexpected error. Cache size is negative"))
+			sg.handleErrorContext(ctx, errors.New("unexpected error. Cache size is negative"))
 			sg.size = 0
 		}
 
 		delete(sg.queue, key)
+		delete(sg.streaming, key)
 		toSend = append(toSend, entry)
 	}
 
+	// Events still waiting on a response are carried over to a new segment,
+	// so the sealed segment can be removed once the batch is uploaded
+	sealed := ""
+	if sg.spool != nil && len(toSend) > 0 {
+		var err error
+		sealed, err = sg.spool.Rotate()
+		if err != nil {
+			sg.handleErrorContext(ctx, err)
+		} else {
+			for key, entry := range sg.queue {
+				if _, ok := sg.unsampled[key]; !ok {
+					sg.appendToSpool(entry)
+				}
+			}
+		}
+	}
+	retries := sg.dueRetries(force)
+	exporting := len(toSend)
+	for _, batch := range retries {
+		exporting += len(batch.events)
+	}
+	sg.exporting += exporting
+	sg.mutex.Unlock()
+	defer func() {
+		sg.mutex.Lock()
+		sg.exporting -= exporting
+		sg.mutex.Unlock()
+	}()
+
+	var err error
+	for _, batch := range retries {
+		if retryErr := sg.upload(ctx, batch, force); retryErr != nil && err == nil {
+			err = retryErr
+		}
+	}
+
 	if len(toSend) == 0 {
-		return nil
+		return err
 	}
 
-	errs := redact.Redact(toSend, &sg.RemoteConfig)
+	// recovered events were redacted before they were spooled
+	errs := redact.Redact(toSend[recovered:], &sg.RemoteConfig)
+	sg.metrics.recordRedactionFailures(len(errs))
 	for _, err := range errs {
-		if err2 := sg.logError(err); err2 != nil {
+		sg.options.Logger.Warn("supergood: redaction failed", "error", err)
+		if err2 := sg.logError(ctx, err); err2 != nil {
 			sg.options.OnError(err2)
 		}
 	}
 
-	sg.logTelemtry(telemetry{
+	sg.logTelemtry(ctx, telemetry{
 		SupergoodApi:  "supergood-go",
 		ServiceName:   sg.options.ServiceName,
 		CacheKeyCount: queueLen,
 		CacheSize:     cacheSize,
 	})
-	return sg.post(sg.options.BaseURL, "/events", toSend)
+	size := 0
+	for _, entry := range toSend {
+		size += entry.Size
+	}
+	for _, batch := range sg.splitBatches(toSend, sealed) {
+		if uploadErr := sg.upload(ctx, batch, force); uploadErr != nil && err == nil {
+			err = uploadErr
+		}
+	}
+	sg.options.Logger.Debug("supergood: flushed events", "events", len(toSend), "bytes", size, "latency", time.Since(start), "final", force)
+	return err
+}
+
+// appendToSpool queues the current state of an event to be redacted and
+// written to the spool, if enabled
+func (sg *Service) appendToSpool(entry *event.Event) {
+	if sg.spool == nil {
+		return
+	}
+	if err := sg.spool.Append(entry); err != nil {
+		sg.handleError(err)
+	}
+}
+
+// recoverSpool queues the events left in the spool by a previous process
+// to be uploaded on the next flush
+func (sg *Service) recoverSpool() {
+	events, leftovers, err := sg.spool.Recover()
+	if err != nil {
+		sg.handleError(err)
+		return
+	}
+	for _, entry := range events {
+		// recovered events are already redacted, so are written as they are
+		if err := sg.spool.Spool.Append(entry); err != nil {
+			sg.handleError(err)
+			return
+		}
+		sg.size += entry.Size
+		sg.recovered = append(sg.recovered, entry)
+	}
+	if err := sg.spool.Commit(leftovers...); err != nil {
+		sg.handleError(err)
+	}
+}
+
+// redactSnapshot redacts an event before it is written to the spool. Redaction failures
+// are reported when the queued copy of the event is redacted for export.
+func (sg *Service) redactSnapshot(e *event.Event) {
+	redact.Redact([]*event.Event{e}, &sg.RemoteConfig)
 }
 
 func (sg *Service) reset() map[string]*event.Event {
@@ -205,6 +495,8 @@ func (sg *Service) reset() map[string]*event.Event {
 
 	entries := sg.queue
 	sg.queue = map[string]*event.Event{}
+	sg.streaming = map[string]*event.Response{}
+	sg.unsampled = map[string]struct{}{}
 	return entries
 }
 
@@ -220,26 +512,55 @@ func getVersion() packageVersion {
 	return packageVersion{Name: "supergood-go", Version: "unknown"}
 }
 
-func (sg *Service) logError(e error) error {
+func (sg *Service) logError(ctx context.Context, e error) error {
+	if sg.options.Offline {
+		return nil
+	}
 	if strings.Contains(e.Error(), "invalid ClientID") {
 		return nil
 	}
 
-	return sg.post(sg.options.TelemetryURL, "/errors", &errorReport{
+	return sg.options.post(ctx, sg.options.TelemetryURL, "/errors", &errorReport{
 		Error:   e.Error(),
 		Message: e.Error(),
 		Payload: getVersion(),
 	})
 }
 
-func (sg *Service) logTelemtry(t telemetry) {
-	err := sg.post(sg.options.TelemetryURL, "/telemetry", t)
+func (sg *Service) logTelemtry(ctx context.Context, t telemetry) {
+	if sg.options.Offline {
+		return
+	}
+	err := sg.options.post(ctx, sg.options.TelemetryURL, "/telemetry", t)
 	if err != nil {
-		sg.handleError(err)
+		sg.handleErrorContext(ctx, err)
 	}
 }
 
-func (sg *Service) post(host string, path string, body any) error {
+func (sg *Service) remoteConfigRefreshed(domains int, latency time.Duration) {
+	sg.metrics.recordConfigRefresh()
+	sg.options.Logger.Debug("supergood: remote config refreshed", "domains", domains, "latency", latency)
+}
+
+func (sg *Service) remoteConfigFailed(err error) {
+	sg.metrics.recordConfigFailure()
+	sg.options.OnError(err)
+}
+
+// telemetry reports the current size of the queue
+func (sg *Service) telemetry() telemetry {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	return telemetry{
+		SupergoodApi:  "supergood-go",
+		ServiceName:   sg.options.ServiceName,
+		CacheKeyCount: len(sg.queue),
+		CacheSize:     sg.size,
+	}
+}
+
+// post sends a JSON payload to the Supergood API, authenticated with the ClientID and ClientSecret
+func (o *Options) post(ctx context.Context, host string, path string, body any) error {
 	url, err := url.JoinPath(host, path)
 	if err != nil { // should not happen as checked in New()
 		return err
@@ -250,13 +571,25 @@ func (sg *Service) post(host string, path string, body any) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(serialized))
+	contentEncoding := ""
+	if o.Compression == "gzip" && len(serialized) >= o.CompressionMinBytes {
+		serialized, err = gzipBytes(serialized)
+		if err != nil {
+			return err
+		}
+		contentEncoding = "gzip"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(serialized))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(sg.options.ClientID+":"+sg.options.ClientSecret)))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(o.ClientID+":"+o.ClientSecret)))
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := sg.options.HTTPClient.Do(req)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	resp, err := o.HTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -265,15 +598,110 @@ func (sg *Service) post(host string, path string, body any) error {
 	if resp.StatusCode == 401 {
 		return fmt.Errorf("supergood: invalid ClientID or ClientSecret")
 	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("supergood: got HTTP %v posting to %v", resp.Status, path)
+		return &postError{
+			status:     resp.Status,
+			statusCode: resp.StatusCode,
+			path:       path,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
 	return nil
 }
 
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// postError is returned when the Supergood API responds with an unexpected status
+type postError struct {
+	status     string
+	statusCode int
+	path       string
+	retryAfter time.Duration
+}
+
+func (e *postError) Error() string {
+	return fmt.Sprintf("supergood: got HTTP %v posting to %v", e.status, e.path)
+}
+
 func (sg *Service) handleError(err error) {
+	sg.handleErrorContext(context.Background(), err)
+}
+
+// handleErrorContext reports an error, giving up on sending it to Supergood once ctx is done
+func (sg *Service) handleErrorContext(ctx context.Context, err error) {
 	sg.options.OnError(err)
-	if err2 := sg.logError(err); err2 != nil {
+	if err2 := sg.logError(ctx, err); err2 != nil {
 		sg.options.OnError(err2)
 	}
 }
+
+// matchEndpoint finds the remote config endpoint matching a request, if any
+func (sg *Service) matchEndpoint(req *http.Request) *remoteconfig.EndpointCacheVal {
+	endpoint, errs := sg.RemoteConfig.MatchRequestAgainstEndpoints(req)
+	for _, err := range errs {
+		sg.handleError(err)
+	}
+	if endpoint == nil {
+		sg.metrics.recordAction("", "Accept")
+		return nil
+	}
+	sg.metrics.recordAction(endpoint.Id, endpoint.Action)
+	sg.options.Logger.Debug("supergood: matched endpoint", "endpointId", endpoint.Id, "action", endpoint.Action, "method", req.Method, "host", req.URL.Host)
+	return endpoint
+}
+
+// bodyLimits returns the maximum request and response body sizes to capture,
+// preferring the limits configured for the matched endpoint
+func (sg *Service) bodyLimits(endpoint *remoteconfig.EndpointCacheVal) (int, int) {
+	maxRequestBodyBytes := sg.options.MaxRequestBodyBytes
+	maxResponseBodyBytes := sg.options.MaxResponseBodyBytes
+	if endpoint != nil {
+		if endpoint.MaxRequestBodyBytes > 0 {
+			maxRequestBodyBytes = endpoint.MaxRequestBodyBytes
+		}
+		if endpoint.MaxResponseBodyBytes > 0 {
+			maxResponseBodyBytes = endpoint.MaxResponseBodyBytes
+		}
+	}
+	return maxRequestBodyBytes, maxResponseBodyBytes
+}
+
+// shouldLogRequest applies the remote config, AllowedDomains and SelectRequests
+// rules to decide whether a request is captured
+func (sg *Service) shouldLogRequest(req *http.Request, endpointAction string) bool {
+	if !sg.RemoteConfig.IsInitialized() {
+		return false
+	}
+
+	if captureDisabled(req.Context()) {
+		return false
+	}
+
+	allowed, err := sg.options.isRequestInAllowedDomains(req)
+	if err != nil {
+		sg.handleError(err)
+	}
+	if !allowed {
+		return false
+	}
+
+	if endpointAction == "Ignore" {
+		return false
+	}
+
+	if sg.options.SelectRequests != nil {
+		return sg.options.SelectRequests(req)
+	}
+
+	return true
+}
@@ -2,19 +2,34 @@ package supergood
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/supergoodsystems/supergood-go/internal/spool"
 	"github.com/supergoodsystems/supergood-go/pkg/event"
 	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var events []*event.Event
@@ -22,10 +37,30 @@ var errorReports []*errorReport
 var broken bool
 var twiceBroken bool
 var remoteConfigBroken bool
+var flakyEvents int
+var eventsEncoding string
+var eventsPosts int
+
+// mockMutex guards the state shared with the mock API server
+var mockMutex sync.Mutex
+
+// receivedEvents returns the events received by the mock API server so far
+func receivedEvents() []*event.Event {
+	mockMutex.Lock()
+	defer mockMutex.Unlock()
+	return append([]*event.Event{}, events...)
+}
+
+func setFlakyEvents(n int) {
+	mockMutex.Lock()
+	defer mockMutex.Unlock()
+	flakyEvents = n
+}
 
 func reset() {
 	events = []*event.Event{}
 	errorReports = []*errorReport{}
+	eventsPosts = 0
 }
 
 var clientID = "test_client_id"
@@ -43,6 +78,101 @@ func (mrt *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 	return http.DefaultTransport.RoundTrip(req)
 }
 
+// recordingLogger keeps the level and message of each record
+type recordingLogger struct {
+	mutex   sync.Mutex
+	records []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record("DEBUG", msg) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record("INFO", msg) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record("WARN", msg) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record("ERROR", msg) }
+
+func (l *recordingLogger) record(level string, msg string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.records = append(l.records, level+" "+msg)
+}
+
+func (l *recordingLogger) messages() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.records...)
+}
+
+// failingExporter fails every export
+type failingExporter struct{}
+
+func (e *failingExporter) Export(ctx context.Context, events []*event.Event) error {
+	return errors.New("export failed")
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// recordingTracerProvider records the attributes spans are started with
+type recordingTracerProvider struct {
+	mutex      sync.Mutex
+	attributes []attribute.KeyValue
+}
+
+func (p *recordingTracerProvider) Tracer(name string, options ...trace.TracerOption) trace.Tracer {
+	return p
+}
+
+func (p *recordingTracerProvider) Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	config := trace.NewSpanStartConfig(options...)
+	p.attributes = append(p.attributes, config.Attributes()...)
+	return ctx, trace.SpanFromContext(ctx)
+}
+
+// flakyExporter fails the first failures exports with a retryable error
+type flakyExporter struct {
+	MemoryExporter
+	mutex    sync.Mutex
+	failures int
+}
+
+func (e *flakyExporter) Export(ctx context.Context, events []*event.Event) error {
+	e.mutex.Lock()
+	if e.failures > 0 {
+		e.failures--
+		e.mutex.Unlock()
+		return &RetryableError{Err: errors.New("export unavailable")}
+	}
+	e.mutex.Unlock()
+	return e.MemoryExporter.Export(ctx, events)
+}
+
+// hangingExporter blocks every export until its context is done
+type hangingExporter struct {
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (e *hangingExporter) Export(ctx context.Context, events []*event.Event) error {
+	close(e.started)
+	<-ctx.Done()
+	close(e.cancelled)
+	return ctx.Err()
+}
+
+// blockingExporter blocks every export until released, ignoring the context
+type blockingExporter struct {
+	release chan struct{}
+}
+
+func (e *blockingExporter) Export(ctx context.Context, events []*event.Event) error {
+	<-e.release
+	return nil
+}
+
 // mock client to test wrapped client behavior
 func mockWrapClient(client *http.Client, ch chan int) *http.Client {
 	client.Transport = &mockRoundTripper{
@@ -65,10 +195,20 @@ func mockServer(t *testing.T, h http.HandlerFunc) string {
 	return "http://" + listener.Addr().String()
 }
 
+// decode gzip compressed payloads sent to the mock servers
+func decodeBody(t *testing.T, r *http.Request) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		r.Body = gz
+	}
+}
+
 // mock api.supergood.ai for testing
 func mockApiServer(t *testing.T) string {
 
 	return mockServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		decodeBody(t, r)
 
 		if r.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(clientID+":"+clientSecret)) {
 			rw.WriteHeader(http.StatusUnauthorized)
@@ -94,11 +234,24 @@ func mockApiServer(t *testing.T) string {
 			return
 		}
 
+		mockMutex.Lock()
+		defer mockMutex.Unlock()
+
+		if r.URL.Path == "/events" && flakyEvents > 0 {
+			flakyEvents--
+			rw.Header().Set("Retry-After", "0")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte(`Unavailable`))
+			return
+		}
+
 		if r.URL.Path == "/events" && r.Method == "POST" {
 			newEvents := []*event.Event{}
 			err := json.NewDecoder(r.Body).Decode(&newEvents)
 			require.NoError(t, err)
 			events = append(events, newEvents...)
+			eventsPosts++
+			eventsEncoding = r.Header.Get("Content-Encoding")
 
 			rw.Write([]byte(`{"message":"Success"}`))
 			return
@@ -139,6 +292,62 @@ func mockApiServer(t *testing.T) string {
 									Action: "Block",
 								},
 							},
+							{
+								Id:     "rate-limited-endpoint-id",
+								Name:   "rate limit me endpoint",
+								Method: "GET",
+								MatchingRegex: remoteconfig.MatchingRegex{
+									Location: "path",
+									Regex:    "/rate-limit-me",
+								},
+								EndpointConfiguration: remoteconfig.EndpointConfiguration{
+									Action:    "Block",
+									RateLimit: &remoteconfig.RateLimit{RequestsPerSecond: 20, Burst: 1},
+								},
+							},
+						},
+					},
+					{
+						Domain: "mocked-domain.com",
+						Endpoints: []remoteconfig.Endpoint{
+							{
+								Id:     "mocked-endpoint-id",
+								Name:   "mock me endpoint",
+								Method: "POST",
+								MatchingRegex: remoteconfig.MatchingRegex{
+									Location: "path",
+									Regex:    "/mock-me",
+								},
+								EndpointConfiguration: remoteconfig.EndpointConfiguration{
+									Action: "Mock",
+									MockResponse: &remoteconfig.MockResponse{
+										Status:  201,
+										Headers: map[string]string{"Content-Type": "application/json"},
+										Body:    `{"mocked":true}`,
+									},
+								},
+							},
+						},
+					},
+					{
+						Domain: "flaky-domain.com",
+						Endpoints: []remoteconfig.Endpoint{
+							{
+								Id:     "flaky-endpoint-id",
+								Name:   "flaky endpoint",
+								Method: "GET",
+								MatchingRegex: remoteconfig.MatchingRegex{
+									Location: "path",
+									Regex:    "/flaky",
+								},
+								EndpointConfiguration: remoteconfig.EndpointConfiguration{
+									Action: "Accept",
+									CircuitBreaker: &remoteconfig.CircuitBreaker{
+										ConsecutiveFailures: 2,
+										CooldownSeconds:     0.1,
+									},
+								},
+							},
 						},
 					},
 					{
@@ -168,6 +377,7 @@ func mockApiServer(t *testing.T) string {
 func mockTelemetryServer(t *testing.T) string {
 
 	return mockServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		decodeBody(t, r)
 
 		if r.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(clientID+":"+clientSecret)) {
 			rw.WriteHeader(http.StatusUnauthorized)
@@ -213,6 +423,12 @@ func testServer(t *testing.T) string {
 			time.Sleep(1 * time.Second)
 		}
 
+		if r.URL.Path == "/stream" {
+			rw.Write([]byte("first,"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+
 		if string(body) == "length-mismatch" {
 			rw.Header().Set("Content-Length", "200")
 		}
@@ -332,12 +548,217 @@ func Test_Supergood(t *testing.T) {
 		reset()
 		sg, err := New(&Options{})
 		require.NoError(t, err)
-		sg.DefaultClient.Get("https://blocked-domain.com/block-me")
+		resp, err := sg.DefaultClient.Get("https://blocked-domain.com/block-me")
+		require.NoError(t, err)
+		require.Equal(t, 429, resp.StatusCode)
+		require.Equal(t, "true", resp.Header.Get("X-Supergood-Blocked"))
+		require.Equal(t, "10", resp.Header.Get("Retry-After"))
+		require.Equal(t, "HTTP/1.1", resp.Proto)
+		require.Equal(t, "/block-me", resp.Request.URL.Path)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.JSONEq(t, `{"error":"Blocked by Supergood: Too many requests","endpointId":"test-endpoint-id","retryAfter":10}`, string(body))
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 1)
+		require.Equal(t, 429, events[0].Response.Status)
+		require.Equal(t, "true", events[0].Response.Headers["X-Supergood-Blocked"])
+		require.Equal(t, event.ErrorBlocked, events[0].Response.Error.Kind)
+
+		reset()
+		sg, err = New(&Options{BlockWithError: true})
+		require.NoError(t, err)
+		_, err = sg.DefaultClient.Get("https://blocked-domain.com/block-me")
+		require.ErrorIs(t, err, ErrBlocked)
 		require.NoError(t, sg.Close())
 		require.Len(t, events, 1)
 		require.Equal(t, 429, events[0].Response.Status)
 	})
 
+	t.Run("Mocked Endpoints", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Post("https://mocked-domain.com/mock-me", "application/json", strings.NewReader(`{"key":"value"}`))
+		require.NoError(t, err)
+		require.Equal(t, 201, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, `{"mocked":true}`, string(body))
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.True(t, events[0].MetaData.Mocked)
+		require.Equal(t, "mocked-endpoint-id", events[0].MetaData.EndpointId)
+		require.Equal(t, 201, events[0].Response.Status)
+		require.Equal(t, map[string]any{"mocked": true}, events[0].Response.Body)
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		reset()
+		changes := []string{}
+		sg, err := New(&Options{OnBreakerChange: func(key string, state string) { changes = append(changes, key+" "+state) }})
+		require.NoError(t, err)
+		calls := 0
+		status := 503
+		client := sg.Wrap(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			calls++
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+		})})
+		get := func() (*http.Response, error) {
+			resp, err := client.Get("https://flaky-domain.com/flaky")
+			if err == nil {
+				resp.Body.Close()
+			}
+			return resp, err
+		}
+
+		// requests cancelled by the caller are not counted as failures
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequestWithContext(cancelled, http.MethodGet, "https://flaky-domain.com/flaky", nil)
+			require.NoError(t, err)
+			_, err = client.Do(req)
+			require.ErrorIs(t, err, context.Canceled)
+		}
+
+		for i := 0; i < 2; i++ {
+			resp, err := get()
+			require.NoError(t, err)
+			require.Equal(t, 503, resp.StatusCode)
+		}
+		_, err = get()
+		require.ErrorIs(t, err, ErrCircuitOpen)
+		var openErr *CircuitOpenError
+		require.ErrorAs(t, err, &openErr)
+		require.Equal(t, "flaky-endpoint-id", openErr.Key)
+		require.Equal(t, 2, calls)
+
+		time.Sleep(150 * time.Millisecond)
+		status = 200
+		for i := 0; i < 2; i++ {
+			resp, err := get()
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+		}
+		require.Equal(t, 4, calls)
+		require.NoError(t, sg.Close())
+		require.Equal(t, []string{"flaky-endpoint-id open", "flaky-endpoint-id half-open", "flaky-endpoint-id closed"}, changes)
+
+		require.Len(t, events, 7)
+		rejected := 0
+		for _, e := range events {
+			if e.MetaData.CircuitOpen {
+				rejected++
+				require.Contains(t, e.Response.Body, "circuit breaker")
+				require.Equal(t, event.ErrorCircuitOpen, e.Response.Error.Kind)
+			}
+		}
+		require.Equal(t, 1, rejected)
+
+		rec := httptest.NewRecorder()
+		sg.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		require.Contains(t, rec.Body.String(), `supergood_circuit_breaker_changes_total{key="flaky-endpoint-id",state="open"} 1`)
+		require.Contains(t, rec.Body.String(), `supergood_circuit_breaker_state{key="flaky-endpoint-id"} 0`)
+
+		// client timeouts count as failures
+		reset()
+		sg, err = New(&Options{})
+		require.NoError(t, err)
+		calls = 0
+		hanging := sg.Wrap(&http.Client{Timeout: 20 * time.Millisecond, Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		})})
+		for i := 0; i < 2; i++ {
+			_, err = hanging.Get("https://flaky-domain.com/flaky")
+			require.Error(t, err)
+			require.NotErrorIs(t, err, ErrCircuitOpen)
+		}
+		_, err = hanging.Get("https://flaky-domain.com/flaky")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+		require.Equal(t, 2, calls)
+		require.NoError(t, sg.Close())
+
+		// requests are rejected until the probe completes, or the cooldown passes again
+		breaker := &circuitBreaker{}
+		config := &remoteconfig.CircuitBreaker{ConsecutiveFailures: 1, CooldownSeconds: 1}
+		now := time.Now()
+		breaker.record(config, true, now)
+		ok, _, _ := breaker.allow(config, now.Add(time.Second))
+		require.True(t, ok)
+		ok, retryAfter, _ := breaker.allow(config, now.Add(1250*time.Millisecond))
+		require.False(t, ok)
+		require.Equal(t, 750*time.Millisecond, retryAfter)
+		ok, _, _ = breaker.allow(config, now.Add(2*time.Second))
+		require.True(t, ok)
+	})
+
+	t.Run("rate limited endpoints", func(t *testing.T) {
+		reset()
+		// the vendor is stubbed, so requests which are not blocked succeed
+		vendor := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok")), Request: req}, nil
+		})}
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		client := sg.Wrap(vendor)
+		rateLimited := func() int {
+			resp, err := client.Get("https://blocked-domain.com/rate-limit-me")
+			require.NoError(t, err)
+			_, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			return resp.StatusCode
+		}
+		require.Equal(t, 200, rateLimited())
+		require.Equal(t, 429, rateLimited())
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 2)
+		sort.Slice(events, func(i, j int) bool { return events[i].Request.RequestedAt.Before(events[j].Request.RequestedAt) })
+		require.Equal(t, 200, events[0].Response.Status)
+		require.Equal(t, 429, events[1].Response.Status)
+
+		reset()
+		sg, err = New(&Options{RateLimitMaxWait: time.Second})
+		require.NoError(t, err)
+		client = sg.Wrap(vendor)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			require.Equal(t, 200, rateLimited())
+		}
+		require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+		// a request which gives up waiting returns its token
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://blocked-domain.com/rate-limit-me", nil)
+		require.NoError(t, err)
+		_, err = client.Do(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		wait, ok := sg.limiter.reserve("rate-limited-endpoint-id", &remoteconfig.RateLimit{RequestsPerSecond: 20, Burst: 1}, time.Second)
+		require.True(t, ok)
+		require.Less(t, wait, 60*time.Millisecond)
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 3)
+
+		// buckets which have refilled are removed
+		limiter := newRateLimiter()
+		limiter.reserve("a", &remoteconfig.RateLimit{RequestsPerSecond: 1000}, time.Second)
+		limiter.swept = time.Now().Add(-bucketSweepInterval)
+		time.Sleep(5 * time.Millisecond)
+		limiter.reserve("b", &remoteconfig.RateLimit{RequestsPerSecond: 1}, time.Second)
+		require.Len(t, limiter.buckets, 1)
+		require.Contains(t, limiter.buckets, "b")
+	})
+
 	t.Run("test timing", func(t *testing.T) {
 		event.Clock = func() time.Time { return time.Date(2023, 01, 01, 01, 01, 01, 0, time.UTC) }
 		defer func() { event.Clock = time.Now }()
@@ -349,6 +770,722 @@ func Test_Supergood(t *testing.T) {
 		require.Equal(t, 2000, events[0].Response.Duration)
 	})
 
+	t.Run("timing breakdown", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		client := sg.Wrap(&http.Client{Transport: &http.Transport{}})
+		for i := 0; i < 2; i++ {
+			resp, err := client.Post(host+"/echo", "text/plain", strings.NewReader("timed"))
+			require.NoError(t, err)
+			_, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 2)
+		reused := 0
+		for _, e := range events {
+			timings := e.Response.Timings
+			require.NotNil(t, timings)
+			require.Greater(t, timings.TimeToFirstByte, 0.0)
+			require.GreaterOrEqual(t, timings.TimeToFirstByte, timings.ServerProcessing)
+			if timings.ConnReused {
+				reused++
+				require.Zero(t, timings.Connect)
+			} else {
+				require.Greater(t, timings.Connect, 0.0)
+			}
+		}
+		require.Equal(t, 1, reused)
+	})
+
+	t.Run("connection details", func(t *testing.T) {
+		reset()
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("secure"))
+		}))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		resp, err := sg.Wrap(server.Client()).Get(server.URL + "/tls")
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		resp, err = sg.DefaultClient.Get(host + "/plain")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 2)
+		for _, e := range events {
+			conn := e.Response.Connection
+			require.NotNil(t, conn)
+			require.Equal(t, "127.0.0.1", conn.RemoteIP)
+			if e.Request.Path == "/tls" {
+				require.Equal(t, "HTTP/2.0", conn.Protocol)
+				require.Equal(t, server.Listener.Addr().(*net.TCPAddr).Port, conn.RemotePort)
+				require.Equal(t, "TLS 1.3", conn.TLSVersion)
+				require.NotEmpty(t, conn.CipherSuite)
+				require.NotNil(t, conn.CertificateExpiry)
+				require.True(t, server.Certificate().NotAfter.Equal(*conn.CertificateExpiry))
+			} else {
+				require.Equal(t, "HTTP/1.1", conn.Protocol)
+				require.Empty(t, conn.TLSVersion)
+				require.Nil(t, conn.CertificateExpiry)
+			}
+		}
+	})
+
+	t.Run("content type aware bodies", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		form := url.Values{"card_number": {"4242424242424242"}, "expand": {"customer", "invoice"}}
+		var multi bytes.Buffer
+		writer := multipart.NewWriter(&multi)
+		require.NoError(t, writer.WriteField("description", "receipt"))
+		file, err := writer.CreateFormFile("upload", "receipt.pdf")
+		require.NoError(t, err)
+		_, err = file.Write([]byte("%PDF-1.4 contents"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		xmlBody := `<charge currency="usd"><amount>100</amount><item>a</item><item>b</item></charge>`
+
+		for contentType, body := range map[string]string{
+			"application/x-www-form-urlencoded": form.Encode(),
+			writer.FormDataContentType():        multi.String(),
+			"application/xml; charset=utf-8":    xmlBody,
+		} {
+			resp, err := sg.DefaultClient.Post(host+"/echo", contentType, strings.NewReader(body))
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 3)
+		for _, e := range events {
+			switch contentType := e.Request.Headers["Content-Type"]; {
+			case contentType == "application/x-www-form-urlencoded":
+				require.Equal(t, map[string]any{
+					"card_number": "4242424242424242",
+					"expand":      []any{"customer", "invoice"},
+				}, e.Request.Body)
+			case strings.HasPrefix(contentType, "multipart/form-data"):
+				require.Equal(t, map[string]any{
+					"description": "receipt",
+					"upload": map[string]any{
+						"filename":    "receipt.pdf",
+						"contentType": "application/octet-stream",
+						"size":        float64(len("%PDF-1.4 contents")),
+					},
+				}, e.Request.Body)
+			default:
+				require.Equal(t, map[string]any{
+					"charge": map[string]any{
+						"@currency": "usd",
+						"amount":    "100",
+						"item":      []any{"a", "b"},
+					},
+				}, e.Request.Body)
+			}
+		}
+
+		// truncated bodies which no longer parse are omitted rather than captured unredacted
+		var binary bytes.Buffer
+		binaryWriter := multipart.NewWriter(&binary)
+		file, err = binaryWriter.CreateFormFile("upload", "photo.jpg")
+		require.NoError(t, err)
+		_, err = file.Write([]byte{0xff, 0xd8, 0xff, 0xe0, 's', 'e', 'c', 'r', 'e', 't'})
+		require.NoError(t, err)
+		require.NoError(t, binaryWriter.Close())
+		jsonBody := `{"card_number":"4242424242424242","name":"Zoë"}`
+
+		for _, test := range []struct {
+			contentType string
+			body        string
+			limit       int
+		}{
+			{writer.FormDataContentType(), xmlBody, 20},
+			{"application/xml", xmlBody, 20},
+			{"application/json", xmlBody, 20},
+			{"text/plain", xmlBody, 20},
+			// cut inside the binary file contents
+			{binaryWriter.FormDataContentType(), binary.String(), strings.Index(binary.String(), "\xff\xd8") + 3},
+			// cut inside the two byte ë
+			{"application/json", jsonBody, strings.Index(jsonBody, "ë") + 1},
+		} {
+			reset()
+			sg, err = New(&Options{MaxRequestBodyBytes: test.limit})
+			require.NoError(t, err)
+			resp, err := sg.DefaultClient.Post(host+"/echo", test.contentType, strings.NewReader(test.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.NoError(t, sg.Close())
+
+			require.Len(t, events, 1)
+			require.True(t, events[0].MetaData.Truncated)
+			if test.contentType == "text/plain" {
+				require.Equal(t, test.body[:test.limit], events[0].Request.Body)
+			} else {
+				require.Nil(t, events[0].Request.Body, test.contentType)
+			}
+		}
+	})
+
+	t.Run("streaming response", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		req, err := http.NewRequest("POST", host+"/stream", strings.NewReader("second"))
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Do(req)
+		require.NoError(t, err)
+		first := make([]byte, len("first,"))
+		_, err = io.ReadFull(resp.Body, first)
+		require.NoError(t, err)
+		require.Equal(t, "first,", string(first))
+		rest, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "second", string(rest))
+		resp.Body.Close()
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.Equal(t, "first,second", events[0].Response.Body)
+		require.GreaterOrEqual(t, events[0].Response.Duration, 100)
+
+		// bodies closed before they are read to the end are flagged as truncated
+		reset()
+		sg, err = New(&Options{})
+		require.NoError(t, err)
+		client := sg.Wrap(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{"Content-Type": {req.URL.Query().Get("type")}}
+			body := io.NopCloser(strings.NewReader(`{"card_number":"4242424242424242"}`))
+			return &http.Response{StatusCode: 200, Header: header, Body: body, ContentLength: -1, Request: req}, nil
+		})})
+		for _, contentType := range []string{"application/json", "text/plain"} {
+			resp, err := client.Get("https://example.com/partial?type=" + url.QueryEscape(contentType))
+			require.NoError(t, err)
+			_, err = io.ReadFull(resp.Body, make([]byte, 10))
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		}
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 2)
+		for _, e := range events {
+			require.True(t, e.MetaData.Truncated)
+			require.Empty(t, e.MetaData.OriginalSize)
+			if e.Response.Headers["Content-Type"] == "text/plain" {
+				require.Equal(t, `{"card_num`, e.Response.Body)
+			} else {
+				require.Nil(t, e.Response.Body)
+			}
+		}
+	})
+
+	t.Run("unread response body", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		_, err = sg.DefaultClient.Get(host + "/stream")
+		require.NoError(t, err)
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.NotNil(t, events[0].Response)
+		require.Equal(t, 200, events[0].Response.Status)
+		require.Nil(t, events[0].Response.Body)
+	})
+
+	t.Run("body size limits", func(t *testing.T) {
+		echoBody(t, &Options{MaxRequestBodyBytes: 5, MaxResponseBodyBytes: 4}, []byte("0123456789"))
+
+		require.Len(t, events, 1)
+		require.Equal(t, "01234", events[0].Request.Body)
+		require.Equal(t, "0123", events[0].Response.Body)
+		require.True(t, events[0].MetaData.Truncated)
+		require.Equal(t, map[string]int{"requestBody": 10, "responseBody": 10}, events[0].MetaData.OriginalSize)
+	})
+
+	t.Run("spooled events are recovered on startup", func(t *testing.T) {
+		reset()
+		dir := t.TempDir()
+		crashed, err := New(&Options{SpoolDir: dir, FlushInterval: time.Hour})
+		require.NoError(t, err)
+		resp, err := crashed.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		resp.Body.Close()
+		// wait for the background writer, as if the process crashed some time later
+		require.NoError(t, crashed.spool.Sync())
+		require.Len(t, events, 0)
+
+		sg, err := New(&Options{SpoolDir: dir})
+		require.NoError(t, err)
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.Equal(t, "/echo", events[0].Request.Path)
+		require.Equal(t, 200, events[0].Response.Status)
+		segments, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, segments, 0)
+	})
+
+	t.Run("spooled events are redacted", func(t *testing.T) {
+		reset()
+		dir := t.TempDir()
+		sg, err := New(&Options{SpoolDir: dir, FlushInterval: time.Hour, ForceRedactAll: true})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Post(host+"/echo", "application/json", strings.NewReader(`{"card":"4242424242424242"}`))
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.NoError(t, sg.spool.Sync())
+
+		files, err := filepath.Glob(filepath.Join(dir, "segment-*.jsonl"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		written, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		require.Contains(t, string(written), `"/echo"`)
+		require.NotContains(t, string(written), "4242424242424242")
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.NotContains(t, fmt.Sprint(events[0].Request.Body), "4242424242424242")
+		redacted := 0
+		for _, key := range events[0].MetaData.SensitiveKeys {
+			if key.KeyPath == "requestBody.card" {
+				redacted++
+			}
+		}
+		require.Equal(t, 1, redacted)
+	})
+
+	t.Run("gzip compressed uploads", func(t *testing.T) {
+		echo(t, &Options{Compression: "gzip", CompressionMinBytes: 1})
+		require.Len(t, events, 1)
+		require.Equal(t, "gzip", eventsEncoding)
+		require.Equal(t, map[string]any{"key": "body"}, events[0].Request.Body)
+
+		echo(t, &Options{Compression: "gzip"})
+		require.Len(t, events, 1)
+		require.Equal(t, "", eventsEncoding)
+	})
+
+	t.Run("bounded batch sizes", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{MaxBatchEvents: 2})
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			resp, err := sg.DefaultClient.Get(host + "/echo")
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 3)
+		require.Equal(t, 2, eventsPosts)
+
+		reset()
+		sg, err = New(&Options{MaxBatchBytes: 1})
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			resp, err := sg.DefaultClient.Get(host + "/echo")
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 3)
+		require.Equal(t, 3, eventsPosts)
+	})
+
+	t.Run("sampling", func(t *testing.T) {
+		random = func() float64 { return 0.5 }
+		defer func() { random = rand.Float64 }()
+		get := func(sg *Service, url string) {
+			resp, err := sg.DefaultClient.Get(url)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+
+		echo(t, &Options{SampleRate: rate(0.4)})
+		require.Len(t, events, 0)
+
+		echo(t, &Options{SampleRate: rate(0.6)})
+		require.Len(t, events, 1)
+		require.Equal(t, 0.6, events[0].MetaData.SampleRate)
+
+		echo(t, &Options{DomainSampleRates: map[string]float64{"127.0.0.1": 0.1}})
+		require.Len(t, events, 0)
+
+		echo(t, &Options{SampleRate: rate(0)})
+		require.Len(t, events, 0)
+
+		reset()
+		dir := t.TempDir()
+		sg, err := New(&Options{SampleRate: rate(0.1), KeepErrors: true, SpoolDir: dir})
+		require.NoError(t, err)
+		get(sg, host+"/echo")
+		get(sg, "https://blocked-domain.com/block-me")
+		require.NoError(t, sg.spool.Sync())
+		files, err := filepath.Glob(filepath.Join(dir, "segment-*.jsonl"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		spooled, err := spool.ReadSegment(files[0])
+		require.NoError(t, err)
+		require.Len(t, spooled, 1)
+		require.Equal(t, "/block-me", spooled[0].Request.Path)
+		require.Equal(t, map[string]int{"sampled": 1}, sg.Stats().DroppedEvents)
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 1)
+		require.Equal(t, 429, events[0].Response.Status)
+		require.Equal(t, 1.0, events[0].MetaData.SampleRate)
+	})
+
+	t.Run("context tags and overrides", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		ctx := WithTags(context.Background(), map[string]string{"tenant": "acme", "feature": "sync"})
+		ctx = WithTags(ctx, map[string]string{"feature": "export"})
+		req, err := http.NewRequestWithContext(ctx, "GET", host+"/echo", nil)
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		req, err = http.NewRequestWithContext(WithoutCapture(ctx), "GET", host+"/echo", nil)
+		require.NoError(t, err)
+		resp, err = sg.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.NoError(t, sg.Close())
+		require.Len(t, events, 1)
+		require.Equal(t, map[string]string{"tenant": "acme", "feature": "export"}, events[0].MetaData.Tags)
+	})
+
+	t.Run("trace correlation", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		sc := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{2},
+			TraceFlags: trace.FlagsSampled,
+		})
+		req, err := http.NewRequestWithContext(trace.ContextWithSpanContext(context.Background(), sc), "GET", host+"/echo", nil)
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.Equal(t, sc.TraceID().String(), events[0].MetaData.TraceId)
+		require.Equal(t, sc.SpanID().String(), events[0].MetaData.SpanId)
+	})
+
+	t.Run("span attributes", func(t *testing.T) {
+		reset()
+		tracer := &recordingTracerProvider{}
+		sg, err := New(&Options{TracerProvider: tracer})
+		require.NoError(t, err)
+		u, err := url.Parse(host + "/echo?api_key=secret-key")
+		require.NoError(t, err)
+		u.User = url.UserPassword("user", "secret-password")
+		resp, err := sg.DefaultClient.Get(u.String())
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.NoError(t, sg.Close())
+
+		attributes := map[attribute.Key]string{}
+		for _, kv := range tracer.attributes {
+			attributes[kv.Key] = kv.Value.Emit()
+			require.NotContains(t, kv.Value.Emit(), "secret")
+		}
+		require.Equal(t, host+"/echo", attributes["http.url"])
+		require.Equal(t, "GET", attributes["http.method"])
+	})
+
+	t.Run("exporters", func(t *testing.T) {
+		memory := &MemoryExporter{}
+		var buf bytes.Buffer
+		echo(t, &Options{Exporters: []Exporter{memory, NewWriterExporter(&buf)}})
+		require.Len(t, events, 0)
+		require.Len(t, memory.Events(), 1)
+		require.Equal(t, "/echo", memory.Events()[0].Request.Path)
+		written := &event.Event{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), written))
+		require.Equal(t, "/echo", written.Request.Path)
+
+		api, err := NewAPIExporter(nil)
+		require.NoError(t, err)
+		memory = &MemoryExporter{}
+		echo(t, &Options{Exporters: []Exporter{api, memory}})
+		require.Len(t, events, 1)
+		require.Len(t, memory.Events(), 1)
+	})
+
+	t.Run("offline mode", func(t *testing.T) {
+		t.Setenv("SUPERGOOD_CLIENT_ID", "")
+		t.Setenv("SUPERGOOD_CLIENT_SECRET", "")
+		dir := t.TempDir()
+		configFile := filepath.Join(dir, "config.json")
+		config := remoteconfig.RemoteConfigResponse{
+			EndpointConfig: []remoteconfig.EndpointConfig{{
+				Domain: "ignored-domain.com",
+				Endpoints: []remoteconfig.Endpoint{{
+					Id:                    "test-endpoint-id",
+					Method:                "GET",
+					MatchingRegex:         remoteconfig.MatchingRegex{Location: "path", Regex: "/ignore-me"},
+					EndpointConfiguration: remoteconfig.EndpointConfiguration{Action: "Ignore"},
+				}},
+			}},
+		}
+		b, err := json.Marshal(config)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(configFile, b, 0o600))
+
+		echo(t, &Options{Offline: true, OfflineDir: filepath.Join(dir, "events"), RemoteConfigFile: configFile})
+		require.Len(t, events, 0)
+		require.Len(t, errorReports, 0)
+
+		files, err := filepath.Glob(filepath.Join(dir, "events", "events-*.jsonl"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		written, err := spool.ReadSegment(files[0])
+		require.NoError(t, err)
+		require.Len(t, written, 1)
+		require.Equal(t, "/echo", written[0].Request.Path)
+
+		sg, err := New(&Options{Offline: true, RemoteConfigFile: configFile, Exporters: []Exporter{&MemoryExporter{}}})
+		require.NoError(t, err)
+		require.NoError(t, sg.Close())
+		require.Len(t, sg.RemoteConfig.Get("ignored-domain.com"), 1)
+
+		_, err = New(&Options{Offline: true, RemoteConfigFile: filepath.Join(dir, "missing.json"), Exporters: []Exporter{&MemoryExporter{}}})
+		require.Error(t, err)
+	})
+
+	t.Run("file exporter rotation", func(t *testing.T) {
+		dir := t.TempDir()
+		exporter := NewFileExporter(FileExporterOptions{Dir: dir, MaxBytes: 1, Gzip: true})
+		for _, id := range []string{"1", "2"} {
+			err := exporter.Export(context.Background(), []*event.Event{{Request: &event.Request{ID: id}}})
+			require.NoError(t, err)
+		}
+		require.NoError(t, exporter.Close())
+		require.Error(t, exporter.Export(context.Background(), []*event.Event{}))
+
+		files, err := filepath.Glob(filepath.Join(dir, "events-*.jsonl.gz"))
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		for _, file := range files {
+			f, err := os.Open(file)
+			require.NoError(t, err)
+			r, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.Equal(t, 1, bytes.Count(b, []byte("\n")))
+		}
+
+		aged := NewFileExporter(FileExporterOptions{Dir: dir, Prefix: "aged", MaxAge: 10 * time.Millisecond, Gzip: true})
+		defer aged.Close()
+		require.NoError(t, aged.Export(context.Background(), []*event.Event{{Request: &event.Request{ID: "1"}}}))
+		files, err = filepath.Glob(filepath.Join(dir, "aged-*.jsonl.gz"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Eventually(t, func() bool {
+			f, err := os.Open(files[0])
+			if err != nil {
+				return false
+			}
+			defer f.Close()
+			r, err := gzip.NewReader(f)
+			if err != nil {
+				return false
+			}
+			_, err = io.ReadAll(r)
+			return err == nil
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("structured logging", func(t *testing.T) {
+		logger := &recordingLogger{}
+		echo(t, &Options{Logger: logger, LogLevel: "debug"})
+		require.Contains(t, logger.messages(), "DEBUG supergood: flushed events")
+		require.Contains(t, logger.messages(), "DEBUG supergood: remote config refreshed")
+
+		logger = &recordingLogger{}
+		echo(t, &Options{Logger: logger, LogLevel: "warn"})
+		require.Empty(t, logger.messages())
+
+		logger = &recordingLogger{}
+		sg, err := New(&Options{Logger: logger, Exporters: []Exporter{&failingExporter{}}})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Error(t, sg.Close())
+		require.Contains(t, logger.messages(), "WARN supergood: dropped events")
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{MaxCacheSizeBytes: 1})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.NoError(t, sg.Close())
+		rec := httptest.NewRecorder()
+		sg.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		require.Contains(t, rec.Body.String(), `supergood_events_dropped_total{reason="cache_full"} 1`)
+
+		sg, err = New(nil)
+		require.NoError(t, err)
+		resp, err = sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.NoError(t, sg.Close())
+
+		rec = httptest.NewRecorder()
+		sg.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		require.Contains(t, rec.Body.String(), "supergood_events_captured_total 1\n")
+		require.Contains(t, rec.Body.String(), "supergood_queue_keys 0\n")
+		require.Contains(t, rec.Body.String(), "supergood_flushes_total 1\n")
+		require.Contains(t, rec.Body.String(), `supergood_endpoint_actions_total{endpoint_id="",action="Accept"} 1`)
+		require.NotContains(t, rec.Body.String(), "supergood_remote_config_age_seconds -1")
+		require.Len(t, events, 1)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{FlushInterval: time.Hour})
+		require.NoError(t, err)
+		stats := sg.Stats()
+		require.True(t, stats.RemoteConfigInitialized)
+		require.NotEmpty(t, stats.RemoteConfigVersion)
+		require.True(t, stats.LastFlush.IsZero())
+
+		resp, err := sg.DefaultClient.Get(host + "/stream")
+		require.NoError(t, err)
+		stats = sg.Stats()
+		require.Equal(t, 1, stats.QueuedEvents)
+		require.Equal(t, 1, stats.InFlightRequests)
+		require.Equal(t, 1, stats.CapturedEvents)
+		require.Greater(t, stats.CacheSizeBytes, 0)
+		require.Equal(t, 100000000, stats.MaxCacheSizeBytes)
+
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, 0, sg.Stats().InFlightRequests)
+
+		require.NoError(t, sg.Close())
+		stats = sg.Stats()
+		require.Equal(t, 0, stats.QueuedEvents)
+		require.False(t, stats.LastFlush.IsZero())
+		require.NoError(t, stats.LastFlushError)
+		require.Len(t, stats.DroppedEvents, 0)
+	})
+
+	t.Run("flush on demand", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{FlushInterval: time.Hour})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.NoError(t, sg.Flush(context.Background()))
+		require.Len(t, events, 1)
+		require.NoError(t, sg.Close())
+		require.Error(t, sg.Flush(context.Background()))
+	})
+
+	t.Run("repeated and concurrent shutdown", func(t *testing.T) {
+		reset()
+		sg, err := New(nil)
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, sg.Shutdown(context.Background()))
+			}()
+		}
+		wg.Wait()
+		require.NoError(t, sg.Close())
+	})
+
+	t.Run("requests after shutdown", func(t *testing.T) {
+		reset()
+		sg, err := New(nil)
+		require.NoError(t, err)
+		require.NoError(t, sg.Close())
+
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.False(t, sg.LogRequest("id", &event.Request{ID: "id"}, ""))
+		require.Equal(t, 0, sg.unsent())
+		require.Len(t, events, 0)
+	})
+
+	t.Run("shutdown deadline", func(t *testing.T) {
+		release := make(chan struct{})
+		sg, err := New(&Options{Exporters: []Exporter{&blockingExporter{release: release}}})
+		require.NoError(t, err)
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err = sg.Shutdown(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Contains(t, err.Error(), "1 events unsent")
+		close(release)
+		require.NoError(t, sg.Close())
+
+		// a periodic flush in progress is cancelled when Shutdown gives up
+		hanging := &hangingExporter{started: make(chan struct{}), cancelled: make(chan struct{})}
+		sg, err = New(&Options{Exporters: []Exporter{hanging}, FlushInterval: 5 * time.Millisecond, OnError: func(error) {}})
+		require.NoError(t, err)
+		resp, err = sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		<-hanging.started
+
+		ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, sg.Shutdown(ctx), context.DeadlineExceeded)
+		select {
+		case <-hanging.cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("export was not cancelled")
+		}
+		require.NoError(t, sg.Close())
+	})
+
 	t.Run("network failure", func(t *testing.T) {
 		reset()
 		sg, err := New(nil)
@@ -362,6 +1499,62 @@ func Test_Supergood(t *testing.T) {
 		require.Equal(t, 0, events[0].Response.Status)
 		require.Equal(t, "HTTP ERROR", events[0].Response.StatusText)
 		require.Contains(t, events[0].Response.Body, "no such host")
+		require.Equal(t, event.ErrorDNS, events[0].Response.Error.Kind)
+		require.Equal(t, events[0].Response.Body, events[0].Response.Error.Message)
+	})
+
+	t.Run("transport error classification", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closed := "http://" + listener.Addr().String()
+		listener.Close()
+		_, err = sg.DefaultClient.Get(closed + "/refused")
+		require.Error(t, err)
+
+		timeoutClient := sg.Wrap(&http.Client{Timeout: 50 * time.Millisecond})
+		_, err = timeoutClient.Get(host + "/sleep")
+		require.Error(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", host+"/cancelled", nil)
+		require.NoError(t, err)
+		_, err = sg.DefaultClient.Do(req)
+		require.Error(t, err)
+
+		resp, err := sg.DefaultClient.Post(host+"/echo", "text/plain", strings.NewReader("length-mismatch"))
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.Error(t, err)
+		resp.Body.Close()
+		require.NoError(t, sg.Close())
+
+		kinds := map[string]event.ErrorKind{}
+		for _, e := range events {
+			require.NotNil(t, e.Response.Error)
+			require.NotEmpty(t, e.Response.Error.Message)
+			kinds[e.Request.Path] = e.Response.Error.Kind
+		}
+		require.Equal(t, map[string]event.ErrorKind{
+			"/refused":   event.ErrorConnectionRefused,
+			"/sleep":     event.ErrorTimeout,
+			"/cancelled": event.ErrorCancelled,
+			"/echo":      event.ErrorBodyRead,
+		}, kinds)
+
+		for err, kind := range map[error]event.ErrorKind{
+			&net.DNSError{Err: "no such host", Name: "example.invalid"}:          event.ErrorDNS,
+			&net.OpError{Op: "remote error", Err: errors.New("bad certificate")}: event.ErrorTLS,
+			x509.UnknownAuthorityError{}:                                         event.ErrorTLS,
+			fmt.Errorf("wrapped: %w", x509.SystemRootsError{}):                   event.ErrorTLS,
+			errors.New("unexpected EOF"):                                         event.ErrorOther,
+		} {
+			require.Equal(t, kind, event.NewResponseError(err).Kind, err.Error())
+		}
 	})
 
 	t.Run("hanging request", func(t *testing.T) {
@@ -408,7 +1601,9 @@ func Test_Supergood(t *testing.T) {
 		sg, err := New(&Options{FlushInterval: 1 * time.Millisecond})
 		require.NoError(t, err)
 		defer sg.Close()
-		sg.DefaultClient.Get(host + "/echo")
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		resp.Body.Close()
 		go sg.DefaultClient.Get(host + "/sleep")
 		time.Sleep(10 * time.Millisecond)
 		require.Len(t, events, 1)
@@ -427,6 +1622,63 @@ func Test_Supergood(t *testing.T) {
 		require.Equal(t, "unknown", errorReports[0].Payload.Version)
 	})
 
+	t.Run("retrying failed uploads", func(t *testing.T) {
+		reset()
+		setFlakyEvents(2)
+		defer setFlakyEvents(0)
+		sg, err := New(&Options{FlushInterval: 5 * time.Millisecond, RetryBackoff: time.Millisecond, OnError: func(error) {}})
+		require.NoError(t, err)
+		defer sg.Close()
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Eventually(t, func() bool { return len(receivedEvents()) == 1 }, time.Second, 5*time.Millisecond)
+		require.Equal(t, "/echo", receivedEvents()[0].Request.Path)
+	})
+
+	t.Run("retrying custom exporters", func(t *testing.T) {
+		exporter := &flakyExporter{failures: 2}
+		sg, err := New(&Options{Exporters: []Exporter{exporter}, FlushInterval: 5 * time.Millisecond, RetryBackoff: time.Millisecond, OnError: func(error) {}})
+		require.NoError(t, err)
+		defer sg.Close()
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.Eventually(t, func() bool { return len(exporter.Events()) == 1 }, time.Second, 5*time.Millisecond)
+		require.Equal(t, "/echo", exporter.Events()[0].Request.Path)
+		require.True(t, isRetryable(fmt.Errorf("wrapped: %w", &RetryableError{Err: io.EOF})))
+		require.False(t, isRetryable(io.EOF))
+	})
+
+	t.Run("dropping events after failed retries", func(t *testing.T) {
+		reset()
+		broken = true
+		defer func() { broken = false }()
+		dropped := make(chan []*event.Event, 1)
+		sg, err := New(&Options{
+			FlushInterval: 5 * time.Millisecond,
+			RetryBackoff:  time.Millisecond,
+			MaxRetries:    1,
+			OnError:       func(error) {},
+			OnDrop:        func(events []*event.Event, err error) { dropped <- events },
+		})
+		require.NoError(t, err)
+		defer sg.Close()
+		resp, err := sg.DefaultClient.Get(host + "/echo")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		select {
+		case events := <-dropped:
+			require.Len(t, events, 1)
+			require.Equal(t, "/echo", events[0].Request.Path)
+		case <-time.After(time.Second):
+			t.Fatal("events were not dropped")
+		}
+	})
+
 	t.Run("handling a broken error handler", func(t *testing.T) {
 		reset()
 		twiceBroken = true
@@ -515,4 +1767,81 @@ func Test_Supergood(t *testing.T) {
 		require.Len(t, events, 1)
 		require.Equal(t, 200, events[0].Response.Status)
 	})
+
+	t.Run("middleware", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		server := mockServer(t, sg.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, "/inbound", r.URL.Path)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusCreated)
+			rw.Write(body)
+		})).ServeHTTP)
+
+		resp, err := http.Post(server+"/inbound?param=1", "application/json", strings.NewReader(`{"key":"body"}`))
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, `{"key":"body"}`, string(b))
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 1)
+		require.Equal(t, server+"/inbound?param=1", events[0].Request.URL)
+		require.Equal(t, "/inbound", events[0].Request.Path)
+		require.Equal(t, map[string]any{"key": "body"}, events[0].Request.Body)
+		require.Equal(t, 201, events[0].Response.Status)
+		require.Equal(t, "201 Created", events[0].Response.StatusText)
+		require.Equal(t, "application/json", events[0].Response.Headers["Content-Type"])
+		require.Equal(t, map[string]any{"key": "body"}, events[0].Response.Body)
+	})
+
+	t.Run("middleware with hijacked connection", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		server := mockServer(t, sg.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			conn, buf, err := rw.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			require.NoError(t, buf.Flush())
+		})).ServeHTTP)
+
+		resp, err := http.Get(server + "/upgrade")
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, "hijacked", string(b))
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 0)
+		require.Zero(t, sg.Stats().CacheSizeBytes)
+	})
+
+	t.Run("middleware with panicking handler", func(t *testing.T) {
+		reset()
+		sg, err := New(&Options{})
+		require.NoError(t, err)
+		handler := sg.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+		for i := 0; i < 3; i++ {
+			require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/panic", nil))
+			})
+		}
+		require.Zero(t, sg.Stats().InFlightRequests)
+		require.NoError(t, sg.Close())
+
+		require.Len(t, events, 3)
+		for _, e := range events {
+			require.Equal(t, 500, e.Response.Status)
+			require.Contains(t, e.Response.Error.Message, "handler panicked")
+		}
+	})
 }
@@ -0,0 +1,63 @@
+package supergood
+
+import (
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/supergoodsystems/supergood-go"
+
+// startSpan starts a client span for a captured request when a TracerProvider is configured,
+// returning the request with the span in its context. The returned span is nil otherwise.
+func (sg *Service) startSpan(req *http.Request, endpointId string, endpointAction string) (*http.Request, trace.Span) {
+	if sg.options.TracerProvider == nil {
+		return req, nil
+	}
+	ctx, span := sg.options.TracerProvider.Tracer(tracerName).Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", spanURL(req.URL)),
+			attribute.String("supergood.endpoint_id", endpointId),
+			attribute.String("supergood.action", endpointAction),
+		),
+	)
+	return req.WithContext(ctx), span
+}
+
+// spanURL returns the scheme, host and path of a URL. The query and user info are
+// left out as they may hold secrets, and spans are not redacted.
+func spanURL(u *url.URL) string {
+	stripped := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}
+	return stripped.String()
+}
+
+// endSpan records the outcome of a request on a span started by startSpan
+func endSpan(span trace.Span, resp *http.Response, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	span.End()
+}
+
+// traceIDs returns the trace and span IDs of the span carried by a request's context, if any
+func traceIDs(req *http.Request) (string, string) {
+	sc := trace.SpanContextFromContext(req.Context())
+	if !sc.IsValid() {
+		return "", ""
+	}
+	return sc.TraceID().String(), sc.SpanID().String()
+}
@@ -1,9 +1,11 @@
 package supergood
 
 import (
+	"context"
 	"net/http"
 	"sync"
 
+	"github.com/supergoodsystems/supergood-go/internal/spool"
 	"github.com/supergoodsystems/supergood-go/pkg/event"
 	remoteconfig "github.com/supergoodsystems/supergood-go/pkg/remote-config"
 )
@@ -20,11 +22,27 @@ type Service struct {
 
 	DefaultClient *http.Client
 
-	close        chan chan error
+	stop         chan context.Context
+	lifetime     context.Context
+	cancel       context.CancelFunc
+	stopOnce     sync.Once
+	done         chan struct{}
+	closeErr     error
+	flushing     chan struct{}
 	mutex        sync.Mutex
 	options      *Options
 	queue        map[string]*event.Event
+	streaming    map[string]*event.Response
+	unsampled    map[string]struct{}
+	recovered    []*event.Event
+	retries      []*retryBatch
 	size         int
+	exporting    int
+	closed       bool
+	spool        *spool.Writer
+	metrics      *metrics
+	limiter      *rateLimiter
+	breakers     *circuitBreakers
 	RemoteConfig remoteconfig.RemoteConfig
 }
 